@@ -17,7 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"os"
+	"path"
 
 	"github.com/hashicorp/vault/api"
 )
@@ -25,6 +27,8 @@ import (
 // the userpass authentication plugin
 type authAppRolePlugin struct {
 	client *api.Client
+	// the secret ids already unwrapped
+	unwrapped *unwrapCache
 }
 
 type appRoleLogin struct {
@@ -34,42 +38,60 @@ type appRoleLogin struct {
 }
 
 // NewAppRolePlugin creates a new App Role plugin
-func NewAppRolePlugin(client *api.Client) AuthInterface {
+func NewAppRolePlugin(client *api.Client, unwrapped *unwrapCache) AuthInterface {
 	return &authAppRolePlugin{
-		client: client,
+		client:    client,
+		unwrapped: unwrapped,
 	}
 }
 
 // Create a approle plugin with the secret id and role id provided in the file
-func (r authAppRolePlugin) Create(cfg *vaultAuthOptions) (string, error) {
+func (r authAppRolePlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
 	if cfg.RoleID == "" {
 		cfg.RoleID = os.Getenv("VAULT_SIDEKICK_ROLE_ID")
 	}
+	loginPath := cfg.loginPath("approle", "VAULT_APPROLE_LOGIN_PATH")
+
+	// step: check for a response-wrapped secret id
+	wrapped, err := readWrappedValue(cfg.WrappedSecretID, cfg.WrappedSecretIDFile, "VAULT_SIDEKICK_WRAPPED_SECRET_ID")
+	if err != nil {
+		return nil, err
+	}
+	if wrapped != "" {
+		creationPath := path.Join(path.Dir(loginPath), "role", "*", "secret-id")
+		cfg.SecretID, err = unwrapCredential(r.client, cfg, r.unwrapped, wrapped, []string{creationPath}, func(secret *api.Secret) (string, error) {
+			secretID, _ := secret.Data["secret_id"].(string)
+			if secretID == "" {
+				return "", fmt.Errorf("the unwrapped response does not contain a secret_id")
+			}
+			return secretID, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 	if cfg.SecretID == "" {
 		cfg.SecretID = os.Getenv("VAULT_SIDEKICK_SECRET_ID")
 	}
-	if cfg.LoginPath == "" {
-		cfg.LoginPath = getEnv("VAULT_APPROLE_LOGIN_PATH", "/v1/auth/approle/login")
-	}
 
 	// step: create the token request
-	request := r.client.NewRequest("POST", cfg.LoginPath)
+	request := r.client.NewRequest("POST", "/v1/"+loginPath)
 	login := appRoleLogin{SecretID: cfg.SecretID, RoleID: cfg.RoleID}
 	if err := request.SetJSONBody(login); err != nil {
-		return "", err
+		return nil, err
 	}
 	// step: make the request
 	resp, err := r.client.RawRequest(request)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// step: parse and return auth
 	secret, err := api.ParseSecret(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return secret.Auth.ClientToken, nil
+	return authFromSecret(secret)
 }
@@ -17,11 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/hashicorp/vault/api"
 )
 
@@ -31,58 +35,119 @@ type authAWSEC2Plugin struct {
 	client *api.Client
 }
 
-// NewUserTokenPlugin creates a new User Token plugin
+// NewAWSEC2Plugin creates a new AWS EC2 plugin
 func NewAWSEC2Plugin(client *api.Client) AuthInterface {
 	return &authAWSEC2Plugin{
 		client: client,
 	}
 }
 
-// Create retrieves the token from an environment variable or file
-func (r authAWSEC2Plugin) Create(cfg *vaultAuthOptions) (string, error) {
-	role := os.Getenv("VAULT_SIDEKICK_ROLE_ID")
+// Create logs in with the signed instance identity document, persisting the client nonce vault returns
+func (r authAWSEC2Plugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	role := cfg.Role
+	if role == "" {
+		role = getEnv("VAULT_SIDEKICK_ROLE_ID", os.Getenv("VAULT_SIDEKICK_ROLE"))
+	}
 	if cfg.FileName != "" {
 		content, err := readConfigFile(cfg.FileName, cfg.FileFormat)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		role = content.RoleID
 	}
+	nonceFile := cfg.NonceFile
+	if nonceFile == "" {
+		nonceFile = os.Getenv("VAULT_SIDEKICK_NONCE_FILE")
+	}
+	document := cfg.IdentityDocument
+	if document == "" {
+		document = getEnv("VAULT_SIDEKICK_AWS_IDENTITY_DOCUMENT", "pkcs7")
+	}
 
-	identity, err := getAWSIdentityDocument()
+	client := &http.Client{Timeout: 10 * time.Second}
+	payload, err := getAWSIdentityDocument(client, awsMetadataURL(cfg), document)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	pkcs := strings.Replace(string(identity), "\n", "", -1)
-	payload := map[string]interface{}{
-		"role":  role,
-		"pkcs7": pkcs,
+	if role != "" {
+		payload["role"] = role
 	}
 
-	nonceFile := os.Getenv("VAULT_SIDEKICK_NONCE_FILE")
-	nonce, err := ioutil.ReadFile(nonceFile)
+	// step: on first use we login without a nonce and vault generates one for us
+	nonce, err := readNonceFile(nonceFile)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if string(nonce) != "" {
-		payload["nonce"] = string(nonce)
+	if nonce != "" {
+		payload["nonce"] = nonce
 	}
 
-	resp, err := r.client.Logical().Write("auth/aws/login", payload)
+	resp, err := r.client.Logical().Write(cfg.loginPath("aws", "VAULT_AWS_LOGIN_PATH"), payload)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	auth, err := authFromSecret(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: the nonce must be presented on every later login from this instance, so we keep it
+	if issued := auth.Metadata["nonce"]; nonce == "" && issued != "" {
+		if nonceFile == "" {
+			glog.Warningf("no nonce file configured, vault will refuse to re-authenticate the instance")
+		} else if err := ioutil.WriteFile(nonceFile, []byte(issued), 0600); err != nil {
+			glog.Errorf("unable to save the nonce to: %s, error: %s", nonceFile, err)
+		} else {
+			glog.Infof("saved the client nonce issued by vault to: %s", nonceFile)
+		}
 	}
 
-	return resp.Auth.ClientToken, nil
+	return auth, nil
 }
 
-func getAWSIdentityDocument() ([]byte, error) {
-	resp, err := http.Get("http://169.254.169.254/latest/dynamic/instance-identity/pkcs7")
+// readNonceFile reads the client nonce, which is empty if the file does not exist yet
+func readNonceFile(filename string) (string, error) {
+	if filename == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
 	}
 
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(content)), nil
+}
+
+// getAWSIdentityDocument retrieves the signed instance identity document, either the pkcs7 signature or
+// the document and its signature
+func getAWSIdentityDocument(client *http.Client, metadataURL, document string) (map[string]interface{}, error) {
+	switch document {
+	case "pkcs7":
+		pkcs7, err := getAWSMetadata(client, metadataURL, "/latest/dynamic/instance-identity/pkcs7")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"pkcs7": strings.Replace(string(pkcs7), "\n", "", -1),
+		}, nil
+	case "identity":
+		identity, err := getAWSMetadata(client, metadataURL, "/latest/dynamic/instance-identity/document")
+		if err != nil {
+			return nil, err
+		}
+		signature, err := getAWSMetadata(client, metadataURL, "/latest/dynamic/instance-identity/signature")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"identity":  base64.StdEncoding.EncodeToString(identity),
+			"signature": strings.Replace(string(signature), "\n", "", -1),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported identity document: %s, should be pkcs7 or identity", document)
+	}
 }
@@ -0,0 +1,98 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEC2Metadata(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "imds-token")
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/pkcs7", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "imds-token", req.Header.Get("X-aws-ec2-metadata-token"))
+		fmt.Fprint(w, "MIAG\nCSqG\n")
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"instanceId": "i-1234"}`)
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/signature", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "c2ln\nbmF0dXJl\n")
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAWSEC2PluginNonce(t *testing.T) {
+	metadata := newTestEC2Metadata(t)
+	nonceFile := filepath.Join(t.TempDir(), "nonce")
+
+	var payloads []map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/aws/login", func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60, "metadata": {"nonce": "issued-nonce"}}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	cfg := &vaultAuthOptions{Role: "app", NonceFile: nonceFile, MetadataURL: metadata.URL}
+
+	// step: the first login is made without a nonce, the one issued is saved
+	auth, err := NewAWSEC2Plugin(client).Create(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, map[string]string{"role": "app", "pkcs7": "MIAGCSqG"}, payloads[0])
+	content, err := ioutil.ReadFile(nonceFile)
+	require.NoError(t, err)
+	assert.Equal(t, "issued-nonce", string(content))
+	stat, err := os.Stat(nonceFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// step: later logins present the saved nonce
+	_, err = NewAWSEC2Plugin(client).Create(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "issued-nonce", payloads[1]["nonce"])
+}
+
+func TestAWSEC2PluginIdentityDocument(t *testing.T) {
+	metadata := newTestEC2Metadata(t)
+
+	payload, err := getAWSIdentityDocument(http.DefaultClient, metadata.URL, "identity")
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"instanceId": "i-1234"}`)), payload["identity"])
+	assert.Equal(t, "c2lnbmF0dXJl", payload["signature"])
+
+	_, err = getAWSIdentityDocument(http.DefaultClient, metadata.URL, "rsa2048")
+	assert.Error(t, err)
+}
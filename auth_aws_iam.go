@@ -0,0 +1,121 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// aws iam authentication plugin
+type authAWSIAMPlugin struct {
+	// the vault client
+	client *api.Client
+}
+
+// NewAWSIAMPlugin creates a new AWS IAM plugin
+func NewAWSIAMPlugin(client *api.Client) AuthInterface {
+	return &authAWSIAMPlugin{
+		client: client,
+	}
+}
+
+// Create logs in with a signed sts:GetCallerIdentity request
+func (r authAWSIAMPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	role := cfg.Role
+	if role == "" {
+		role = os.Getenv("VAULT_SIDEKICK_ROLE")
+	}
+	serverID := cfg.IAMServerID
+	if serverID == "" {
+		serverID = os.Getenv("VAULT_SIDEKICK_IAM_SERVER_ID")
+	}
+	loginPath := cfg.loginPath("aws", "VAULT_AWS_LOGIN_PATH")
+	stsEndpoint := cfg.STSEndpoint
+	if stsEndpoint == "" {
+		stsEndpoint = getEnv("VAULT_SIDEKICK_AWS_STS_ENDPOINT", defaultAWSSTSEndpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = getEnv("VAULT_SIDEKICK_AWS_REGION", defaultAWSRegion)
+	}
+
+	creds, err := newAWSCredentialChain(awsMetadataURL(cfg), stsEndpoint).Retrieve()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := newAWSIAMLoginPayload(creds, stsEndpoint, region, serverID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if role != "" {
+		payload["role"] = role
+	}
+
+	glog.V(3).Infof("requesting a vault token for role: %s using aws iam credentials from: %s", role, creds.Source)
+
+	secret, err := r.client.Logical().Write(loginPath, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
+
+// newAWSIAMLoginPayload builds the signed sts:GetCallerIdentity request which vault replays to identify us
+func newAWSIAMLoginPayload(creds *awsCredentials, stsEndpoint, region, serverID string, now time.Time) (map[string]interface{}, error) {
+	body := []byte("Action=GetCallerIdentity&Version=2011-06-15")
+	request, err := http.NewRequest("POST", strings.TrimSuffix(stsEndpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if serverID != "" {
+		request.Header.Set("X-Vault-AWS-IAM-Server-ID", serverID)
+	}
+	signAWSRequest(request, body, creds, region, "sts", now)
+
+	headers, err := json.Marshal(request.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"iam_http_request_method": request.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(request.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+// awsMetadataURL returns the base url of the instance metadata service
+func awsMetadataURL(cfg *vaultAuthOptions) string {
+	if cfg.MetadataURL != "" {
+		return strings.TrimSuffix(cfg.MetadataURL, "/")
+	}
+
+	return strings.TrimSuffix(getEnv("VAULT_SIDEKICK_AWS_METADATA_URL", defaultAWSMetadataURL), "/")
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// cases from the aws signature version 4 test suite
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	for _, c := range []struct {
+		Name          string
+		Method        string
+		URL           string
+		ContentType   string
+		Body          string
+		SignedHeaders string
+		Signature     string
+	}{
+		{
+			Name:          "get-vanilla",
+			Method:        "GET",
+			URL:           "https://example.amazonaws.com/",
+			SignedHeaders: "host;x-amz-date",
+			Signature:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			Name:          "get-vanilla-query-order-key-case",
+			Method:        "GET",
+			URL:           "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			SignedHeaders: "host;x-amz-date",
+			Signature:     "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			Name:          "post-vanilla",
+			Method:        "POST",
+			URL:           "https://example.amazonaws.com/",
+			SignedHeaders: "host;x-amz-date",
+			Signature:     "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			Name:          "post-x-www-form-urlencoded",
+			Method:        "POST",
+			URL:           "https://example.amazonaws.com/",
+			ContentType:   "application/x-www-form-urlencoded",
+			Body:          "Param1=value1",
+			SignedHeaders: "content-type;host;x-amz-date",
+			Signature:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			Name:          "post-x-www-form-urlencoded-parameters",
+			Method:        "POST",
+			URL:           "https://example.amazonaws.com/",
+			ContentType:   "application/x-www-form-urlencoded; charset=utf8",
+			Body:          "Param1=value1",
+			SignedHeaders: "content-type;host;x-amz-date",
+			Signature:     "1a72ec8f64bd914b0e42e42607c7fbce7fb2c7465f63e3092b3b0d39fa77a6fe",
+		},
+	} {
+		request, err := http.NewRequest(c.Method, c.URL, strings.NewReader(c.Body))
+		require.NoError(t, err)
+		if c.ContentType != "" {
+			request.Header.Set("Content-Type", c.ContentType)
+		}
+		signAWSRequest(request, []byte(c.Body), creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		assert.Equal(t, "20150830T123600Z", request.Header.Get("X-Amz-Date"), c.Name)
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders="+c.SignedHeaders+", Signature="+c.Signature, request.Header.Get("Authorization"), c.Name)
+	}
+
+	// step: a session token is signed along with the request
+	request, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	signAWSRequest(request, nil, &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"},
+		"us-east-1", "service", time.Now())
+	assert.Equal(t, "session", request.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, request.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+func TestAWSIAMPluginWithInstanceMetadata(t *testing.T) {
+	clearTestAWSEnvironment(t)
+
+	metadata := http.NewServeMux()
+	metadata.HandleFunc("/latest/api/token", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		fmt.Fprint(w, "imds-token")
+	})
+	metadata.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "imds-token", req.Header.Get("X-aws-ec2-metadata-token"))
+		if strings.HasSuffix(req.URL.Path, "/sidekick") {
+			fmt.Fprint(w, `{"AccessKeyId": "AKID", "SecretAccessKey": "secret", "Token": "session"}`)
+			return
+		}
+		fmt.Fprint(w, "sidekick\n")
+	})
+	metadataServer := httptest.NewServer(metadata)
+	defer metadataServer.Close()
+
+	var payload map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/aws-prod/login", func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	auth, err := NewAWSIAMPlugin(client).Create(&vaultAuthOptions{
+		Role:        "app",
+		IAMServerID: "vault.example.com",
+		LoginPath:   "auth/aws-prod/login",
+		MetadataURL: metadataServer.URL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+
+	assert.Equal(t, "app", payload["role"])
+	assert.Equal(t, "POST", payload["iam_http_request_method"])
+	decode := func(key string) string {
+		value, err := base64.StdEncoding.DecodeString(payload[key])
+		require.NoError(t, err)
+		return string(value)
+	}
+	assert.Equal(t, "https://sts.amazonaws.com/", decode("iam_request_url"))
+	assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", decode("iam_request_body"))
+
+	var headers map[string][]string
+	require.NoError(t, json.Unmarshal([]byte(decode("iam_request_headers")), &headers))
+	assert.Equal(t, []string{"vault.example.com"}, headers["X-Vault-Aws-Iam-Server-Id"])
+	assert.Equal(t, []string{"session"}, headers["X-Amz-Security-Token"])
+	assert.Contains(t, headers["Authorization"][0], "Credential=AKID/")
+	assert.Contains(t, headers["Authorization"][0], "x-vault-aws-iam-server-id")
+}
+
+// clearTestAWSEnvironment removes any aws credentials of the environment the tests are run in
+func clearTestAWSEnvironment(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY",
+		"AWS_SESSION_TOKEN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME", "AWS_PROFILE",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+}
+
+func TestAWSCredentialsFromEnvironment(t *testing.T) {
+	clearTestAWSEnvironment(t)
+	t.Setenv("AWS_ACCESS_KEY", "AKID")
+	t.Setenv("AWS_SECRET_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	creds, err := newAWSCredentialChain("http://127.0.0.1:0", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session", Source: "environment"}, creds)
+
+	// step: the standard variables take precedence over the legacy ones
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID2")
+	creds, err = newAWSCredentialChain("http://127.0.0.1:0", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID2", creds.AccessKeyID)
+}
+
+func TestAWSCredentialsFromWebIdentity(t *testing.T) {
+	clearTestAWSEnvironment(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("web-identity-token\n"), 0600))
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/app")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "sidekick")
+
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		assert.Equal(t, "AssumeRoleWithWebIdentity", req.Form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/app", req.Form.Get("RoleArn"))
+		assert.Equal(t, "sidekick", req.Form.Get("RoleSessionName"))
+		assert.Equal(t, "web-identity-token", req.Form.Get("WebIdentityToken"))
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIA</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer sts.Close()
+
+	creds, err := newAWSCredentialChain("http://127.0.0.1:0", sts.URL).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session", Source: "web-identity"}, creds)
+}
+
+func TestAWSCredentialsFromSharedCredentials(t *testing.T) {
+	clearTestAWSEnvironment(t)
+	filename := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`# comment
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default
+
+[app]
+aws_access_key_id=AKIDAPP
+aws_secret_access_key=app
+aws_session_token = session
+`), 0600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filename)
+
+	creds, err := newAWSCredentialChain("http://127.0.0.1:0", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "AKIDDEFAULT", SecretAccessKey: "default", Source: "shared-credentials"}, creds)
+
+	t.Setenv("AWS_PROFILE", "app")
+	creds, err = newAWSCredentialChain("http://127.0.0.1:0", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "AKIDAPP", SecretAccessKey: "app", SessionToken: "session", Source: "shared-credentials"}, creds)
+}
+
+func TestAWSCredentialsFromContainer(t *testing.T) {
+	clearTestAWSEnvironment(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("pod-identity-token\n"), 0600))
+
+	container := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/credentials", req.URL.Path)
+		assert.Equal(t, "pod-identity-token", req.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"AccessKeyId": "ASIA", "SecretAccessKey": "secret", "Token": "session", "Expiration": "2030-01-01T00:00:00Z"}`)
+	}))
+	defer container.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", container.URL+"/v1/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+
+	creds, err := newAWSCredentialChain("http://127.0.0.1:0", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session", Source: "container"}, creds)
+}
+
+func TestAWSCredentialsFromInstanceMetadata(t *testing.T) {
+	clearTestAWSEnvironment(t)
+
+	// step: the metadata service only supports IMDSv1, so the request is made without a session token
+	metadata := http.NewServeMux()
+	metadata.HandleFunc("/latest/api/token", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	metadata.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, req *http.Request) {
+		assert.Empty(t, req.Header.Get("X-aws-ec2-metadata-token"))
+		if strings.HasSuffix(req.URL.Path, "/sidekick") {
+			fmt.Fprint(w, `{"AccessKeyId": "ASIA", "SecretAccessKey": "secret", "Token": "session"}`)
+			return
+		}
+		fmt.Fprint(w, "sidekick")
+	})
+	metadataServer := httptest.NewServer(metadata)
+	defer metadataServer.Close()
+
+	creds, err := newAWSCredentialChain(metadataServer.URL+"/", defaultAWSSTSEndpoint).Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, &awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session", Source: "instance-metadata"}, creds)
+
+	// step: without any credentials the errors of the providers are returned
+	metadataServer.Close()
+	_, err = newAWSCredentialChain(metadataServer.URL, defaultAWSSTSEndpoint).Retrieve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "instance-metadata:")
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// defaultAzureMetadataURL is the address of the azure instance metadata service
+	defaultAzureMetadataURL = "http://169.254.169.254"
+	// defaultAzureResource is the resource the managed identity token is requested for
+	defaultAzureResource = "https://management.azure.com/"
+)
+
+// azure authentication plugin
+type authAzurePlugin struct {
+	// the vault client
+	client *api.Client
+}
+
+// azureComputeMetadata is the compute section of the azure instance metadata
+type azureComputeMetadata struct {
+	SubscriptionID    string `json:"subscriptionId"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	Name              string `json:"name"`
+	VMScaleSetName    string `json:"vmScaleSetName"`
+}
+
+// NewAzurePlugin creates a new Azure plugin
+func NewAzurePlugin(client *api.Client) AuthInterface {
+	return &authAzurePlugin{
+		client: client,
+	}
+}
+
+// Create logs in with a managed identity token and the instance metadata from the azure metadata service
+func (r authAzurePlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	role := cfg.Role
+	if role == "" {
+		role = os.Getenv("VAULT_SIDEKICK_ROLE")
+	}
+	if role == "" {
+		return nil, permanent(fmt.Errorf("no role provided for the azure authentication"))
+	}
+	metadataURL := cfg.MetadataURL
+	if metadataURL == "" {
+		metadataURL = getEnv("VAULT_SIDEKICK_AZURE_METADATA_URL", defaultAzureMetadataURL)
+	}
+	metadataURL = strings.TrimSuffix(metadataURL, "/")
+	resource := cfg.Resource
+	if resource == "" {
+		resource = getEnv("VAULT_SIDEKICK_AZURE_RESOURCE", defaultAzureResource)
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = os.Getenv("VAULT_SIDEKICK_AZURE_CLIENT_ID")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	token, err := getAzureManagedIdentityToken(client, metadataURL, resource, clientID)
+	if err != nil {
+		return nil, err
+	}
+	compute, err := getAzureComputeMetadata(client, metadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"role":                role,
+		"jwt":                 token,
+		"subscription_id":     compute.SubscriptionID,
+		"resource_group_name": compute.ResourceGroupName,
+	}
+	// step: instances in a scale set must login with the name of the scale set
+	if compute.VMScaleSetName != "" {
+		payload["vmss_name"] = compute.VMScaleSetName
+	} else {
+		payload["vm_name"] = compute.Name
+	}
+
+	glog.V(3).Infof("requesting a vault token for role: %s, subscription: %s, resource group: %s",
+		role, compute.SubscriptionID, compute.ResourceGroupName)
+
+	secret, err := r.client.Logical().Write(cfg.loginPath("azure", "VAULT_AZURE_LOGIN_PATH"), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
+
+// getAzureManagedIdentityToken retrieves an access token for the managed identity of the instance
+func getAzureManagedIdentityToken(client *http.Client, metadataURL, resource, clientID string) (string, error) {
+	values := url.Values{}
+	values.Set("api-version", "2018-02-01")
+	values.Set("resource", resource)
+	if clientID != "" {
+		values.Set("client_id", clientID)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := getAzureMetadata(client, metadataURL+"/metadata/identity/oauth2/token?"+values.Encode(), &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token returned by the azure metadata service")
+	}
+
+	return token.AccessToken, nil
+}
+
+// getAzureComputeMetadata retrieves the compute metadata of the instance
+func getAzureComputeMetadata(client *http.Client, metadataURL string) (*azureComputeMetadata, error) {
+	var metadata struct {
+		Compute azureComputeMetadata `json:"compute"`
+	}
+	if err := getAzureMetadata(client, metadataURL+"/metadata/instance?api-version=2021-02-01", &metadata); err != nil {
+		return nil, err
+	}
+
+	return &metadata.Compute, nil
+}
+
+// getAzureMetadata performs a request to the azure metadata service and decodes the response
+func getAzureMetadata(client *http.Client, endpoint string, result interface{}) error {
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Metadata", "true")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the azure metadata service returned status: %d, response: %s", resp.StatusCode, content)
+	}
+
+	return json.Unmarshal(content, result)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzurePlugin(t *testing.T) {
+	metadata := http.NewServeMux()
+	metadata.HandleFunc("/metadata/identity/oauth2/token", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.Header.Get("Metadata"))
+		assert.Equal(t, "https://vault.example.com", req.URL.Query().Get("resource"))
+		assert.Equal(t, "identity", req.URL.Query().Get("client_id"))
+		fmt.Fprint(w, `{"access_token": "azure-token"}`)
+	})
+	metadata.HandleFunc("/metadata/instance", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.Header.Get("Metadata"))
+		fmt.Fprint(w, `{"compute": {"subscriptionId": "sub", "resourceGroupName": "rg", "name": "vm_1", "vmScaleSetName": "vmss"}}`)
+	})
+	metadataServer := httptest.NewServer(metadata)
+	defer metadataServer.Close()
+
+	var payload map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/azure/login", func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	auth, err := NewAzurePlugin(client).Create(&vaultAuthOptions{
+		Role:        "app",
+		Resource:    "https://vault.example.com",
+		ClientID:    "identity",
+		MetadataURL: metadataServer.URL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, map[string]string{
+		"role":                "app",
+		"jwt":                 "azure-token",
+		"subscription_id":     "sub",
+		"resource_group_name": "rg",
+		"vmss_name":           "vmss",
+	}, payload)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// tls certificate authentication plugin
+type authCertPlugin struct {
+	// the vault client
+	client *api.Client
+}
+
+// NewCertPlugin creates a new TLS certificate plugin
+func NewCertPlugin(client *api.Client) AuthInterface {
+	return &authCertPlugin{
+		client: client,
+	}
+}
+
+// Create logs in with the client certificate presented on the transport
+func (r authCertPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	role := cfg.Role
+	if role == "" {
+		role = os.Getenv("VAULT_SIDEKICK_ROLE")
+	}
+	loginPath := cfg.loginPath("cert", "VAULT_CERT_LOGIN_PATH")
+
+	// step: the role is optional, vault will match the certificate against all the roles otherwise
+	payload := map[string]interface{}{}
+	if role != "" {
+		payload["name"] = role
+	}
+
+	secret, err := r.client.Logical().Write(loginPath, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertPlugin(t *testing.T) {
+	var login map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/cert-prod/login", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		login = nil
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60, "renewable": true}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	t.Setenv("VAULT_SIDEKICK_ROLE", "")
+
+	auth, err := NewCertPlugin(client).Create(&vaultAuthOptions{Role: "web", Mount: "cert-prod"})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, map[string]string{"name": "web"}, login)
+
+	// step: without a role vault matches the certificate against all of them
+	_, err = NewCertPlugin(client).Create(&vaultAuthOptions{LoginPath: "auth/cert-prod/login"})
+	require.NoError(t, err)
+	assert.Empty(t, login)
+}
@@ -39,12 +39,12 @@ func NewGCPGCEPlugin(client *api.Client) AuthInterface {
 }
 
 // Create retrieves the token from an environment variable or file
-func (r authGCPGCEPlugin) Create(cfg *vaultAuthOptions) (string, error) {
+func (r authGCPGCEPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
 	role := os.Getenv("VAULT_SIDEKICK_ROLE_ID")
 	if cfg.FileName != "" {
 		content, err := readConfigFile(cfg.FileName, cfg.FileFormat)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		role = content.RoleID
@@ -52,19 +52,19 @@ func (r authGCPGCEPlugin) Create(cfg *vaultAuthOptions) (string, error) {
 
 	jwtToken, err := getGCPServiceAccountToken(role)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	payload := map[string]interface{}{
 		"role": role,
 		"jwt":  string(jwtToken),
 	}
 
-	resp, err := r.client.Logical().Write("auth/gcp/login", payload)
+	resp, err := r.client.Logical().Write(cfg.loginPath("gcp", "VAULT_GCP_LOGIN_PATH"), payload)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return resp.Auth.ClientToken, nil
+	return authFromSecret(resp)
 }
 
 // getGCPServiceAccountToken retrieves a JWT token from GCP metadata service
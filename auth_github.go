@@ -0,0 +1,55 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// the github authentication plugin
+type authGitHubPlugin struct {
+	client *api.Client
+}
+
+// NewGitHubPlugin creates a new GitHub plugin
+func NewGitHubPlugin(client *api.Client) AuthInterface {
+	return &authGitHubPlugin{
+		client: client,
+	}
+}
+
+// Create logs in with the github personal access token provided in the file or environment
+func (r authGitHubPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	if cfg.GitHubToken == "" {
+		cfg.GitHubToken = os.Getenv("VAULT_SIDEKICK_GITHUB_TOKEN")
+	}
+	if cfg.GitHubToken == "" {
+		return nil, permanent(fmt.Errorf("no github token provided for the github authentication"))
+	}
+
+	secret, err := r.client.Logical().Write(cfg.loginPath("github", "VAULT_GITHUB_LOGIN_PATH"), map[string]interface{}{
+		"token": cfg.GitHubToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
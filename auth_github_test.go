@@ -0,0 +1,52 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubPlugin(t *testing.T) {
+	var login map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/github-org/login", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60, "renewable": true}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	auth, err := NewGitHubPlugin(client).Create(&vaultAuthOptions{GitHubToken: "ghp_token", Mount: "github-org"})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, map[string]string{"token": "ghp_token"}, login)
+}
+
+func TestGitHubPluginWithoutToken(t *testing.T) {
+	t.Setenv("VAULT_SIDEKICK_GITHUB_TOKEN", "")
+	client := newTestVaultClient(t, http.NewServeMux())
+
+	_, err := NewGitHubPlugin(client).Create(&vaultAuthOptions{})
+	assert.Error(t, err)
+	assert.True(t, isPermanentError(err))
+}
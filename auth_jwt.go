@@ -0,0 +1,97 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// jwt / oidc authentication plugin
+type authJWTPlugin struct {
+	// the vault client
+	client *api.Client
+}
+
+// NewJWTPlugin creates a new JWT plugin
+func NewJWTPlugin(client *api.Client) AuthInterface {
+	return &authJWTPlugin{
+		client: client,
+	}
+}
+
+// Create logs in with a JWT read from a file or environment variable
+func (r authJWTPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	role := cfg.Role
+	if role == "" {
+		role = os.Getenv("VAULT_SIDEKICK_ROLE")
+	}
+	if role == "" {
+		return nil, permanent(fmt.Errorf("no role provided for the jwt authentication"))
+	}
+	loginPath := cfg.loginPath("jwt", "VAULT_JWT_LOGIN_PATH")
+
+	jwt, err := readJWT(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.V(3).Infof("requesting a vault token for role: %s using jwt login: %s", role, loginPath)
+
+	secret, err := r.client.Logical().Write(loginPath, map[string]interface{}{
+		"jwt":  jwt,
+		"role": role,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
+
+// readJWT retrieves the jwt, the file is read on every login as the token is expected to be rotated
+func readJWT(cfg *vaultAuthOptions) (string, error) {
+	filename := cfg.JWTFile
+	if filename == "" {
+		filename = os.Getenv("VAULT_SIDEKICK_JWT_FILE")
+	}
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the jwt file: %s, error: %s", filename, err)
+		}
+		jwt := string(bytes.TrimSpace(content))
+		if jwt == "" {
+			return "", fmt.Errorf("the jwt file: %s is empty", filename)
+		}
+
+		return jwt, nil
+	}
+	if cfg.JWT != "" {
+		return cfg.JWT, nil
+	}
+	if jwt := os.Getenv("VAULT_SIDEKICK_JWT"); jwt != "" {
+		return jwt, nil
+	}
+
+	return "", permanent(fmt.Errorf("no jwt provided, set VAULT_SIDEKICK_JWT_FILE or VAULT_SIDEKICK_JWT"))
+}
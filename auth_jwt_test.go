@@ -0,0 +1,57 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTPluginRereadsFile(t *testing.T) {
+	var logins []map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/ci-jwt/login", func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		logins = append(logins, body)
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60, "renewable": true}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	filename := filepath.Join(t.TempDir(), "token")
+	cfg := &vaultAuthOptions{Role: "ci", JWTFile: filename, LoginPath: "auth/ci-jwt/login"}
+
+	require.NoError(t, os.WriteFile(filename, []byte("first\n"), 0600))
+	auth, err := NewJWTPlugin(client).Create(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+
+	require.NoError(t, os.WriteFile(filename, []byte("second"), 0600))
+	_, err = NewJWTPlugin(client).Create(cfg)
+	require.NoError(t, err)
+
+	require.Len(t, logins, 2)
+	assert.Equal(t, map[string]string{"jwt": "first", "role": "ci"}, logins[0])
+	assert.Equal(t, "second", logins[1]["jwt"])
+}
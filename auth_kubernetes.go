@@ -18,10 +18,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"strings"
 
 	"github.com/golang/glog"
 
@@ -46,34 +48,88 @@ func NewKubernetesPlugin(client *api.Client) AuthInterface {
 	}
 }
 
-func (r authKubernetesPlugin) Create(cfg *vaultAuthOptions) (string, error) {
-	vaultRole, ok := os.LookupEnv("VAULT_SIDEKICK_ROLE")
-
-	if !ok {
-		return "", fmt.Errorf("VAULT_SIDEKICK_ROLE not provided")
+// Create logs in with the service account token, the token is read on every login as bound
+// projected service account tokens are rotated by the kubelet
+func (r authKubernetesPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	vaultRole := cfg.Role
+	if vaultRole == "" {
+		vaultRole = os.Getenv("VAULT_SIDEKICK_ROLE")
+	}
+	if vaultRole == "" {
+		return nil, permanent(fmt.Errorf("VAULT_SIDEKICK_ROLE not provided"))
 	}
 
 	// in case you mounted your kubernetes auth engine somewhere else
-	loginPath := getEnv("VAULT_K8S_LOGIN_PATH", "/v1/auth/kubernetes/login")
+	loginPath := cfg.loginPath("kubernetes", "VAULT_K8S_LOGIN_PATH")
 
-	tokenPath := getEnv("VAULT_K8S_TOKEN_PATH", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	tokenPath := cfg.TokenPath
+	if tokenPath == "" {
+		tokenPath = getEnv("VAULT_K8S_TOKEN_PATH", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	}
+	audience := cfg.Audience
+	if audience == "" {
+		audience = os.Getenv("VAULT_K8S_AUDIENCE")
+	}
 
 	// read the JWT from the token file
-	token, err := ioutil.ReadFile(tokenPath)
+	content, err := ioutil.ReadFile(tokenPath)
 	if err != nil {
-		glog.Error("Error reading token file: ", err.Error())
-		return "", err
+		return nil, fmt.Errorf("unable to read the service account token: %s, error: %s", tokenPath, err)
+	}
+	token := string(bytes.TrimSpace(content))
+
+	// step: a token for the wrong audience would be rejected by vault with a rather unhelpful error
+	if audience != "" {
+		if err := checkJWTAudience(token, audience); err != nil {
+			return nil, fmt.Errorf("the service account token: %s, %s", tokenPath, err)
+		}
 	}
 
 	glog.Infof("Requesting for role %s vault-token..", vaultRole)
 
-	secret, err := r.client.Logical().Write(path.Join(loginPath, "login"), map[string]interface{}{
-		"jwt":  string(bytes.TrimSpace(token)),
+	secret, err := r.client.Logical().Write(loginPath, map[string]interface{}{
+		"jwt":  token,
 		"role": vaultRole,
 	})
 	if err != nil {
-		glog.Fatal(err.Error())
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
+
+// checkJWTAudience checks the audience claim of the jwt contains the audience
+func checkJWTAudience(token, audience string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("is not a valid jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("has an invalid payload, error: %s", err)
+	}
+
+	var claims struct {
+		Audience interface{} `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("has an invalid payload, error: %s", err)
+	}
+
+	var audiences []string
+	switch aud := claims.Audience.(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, x := range aud {
+			audiences = append(audiences, fmt.Sprintf("%v", x))
+		}
+	}
+	for _, x := range audiences {
+		if x == audience {
+			return nil
+		}
 	}
 
-	return secret.Auth.ClientToken, nil
+	return fmt.Errorf("was issued for the audience: %v, expected: %s", audiences, audience)
 }
@@ -0,0 +1,77 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestJWT creates an unsigned jwt with the claims
+func newTestJWT(claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"RS256"}`)) + "." + encode([]byte(claims)) + ".signature"
+}
+
+func TestKubernetesPlugin(t *testing.T) {
+	var logins []kubernetesLogin
+	status := http.StatusOK
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, req *http.Request) {
+		var login kubernetesLogin
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+		logins = append(logins, login)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	t.Setenv("VAULT_K8S_LOGIN_PATH", "")
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	cfg := &vaultAuthOptions{Role: "app", TokenPath: tokenPath, Audience: "vault"}
+
+	require.NoError(t, os.WriteFile(tokenPath, []byte(newTestJWT(`{"aud": ["vault"]}`)), 0600))
+	_, err := NewKubernetesPlugin(client).Create(cfg)
+	require.NoError(t, err)
+
+	// step: the rotated token should be read on the next login
+	rotated := newTestJWT(`{"aud": "vault", "iat": 2}`)
+	require.NoError(t, os.WriteFile(tokenPath, []byte(rotated+"\n"), 0600))
+	_, err = NewKubernetesPlugin(client).Create(cfg)
+	require.NoError(t, err)
+	require.Len(t, logins, 2)
+	assert.Equal(t, kubernetesLogin{Role: "app", Jwt: rotated}, logins[1])
+
+	// step: a login error is returned rather than exiting
+	status = http.StatusForbidden
+	_, err = NewKubernetesPlugin(client).Create(cfg)
+	assert.Error(t, err)
+
+	// step: a token issued for another audience is rejected before login
+	require.NoError(t, os.WriteFile(tokenPath, []byte(newTestJWT(`{"aud": ["kubernetes"]}`)), 0600))
+	_, err = NewKubernetesPlugin(client).Create(cfg)
+	assert.Error(t, err)
+	assert.Len(t, logins, 3)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// the ldap authentication plugin
+type authLDAPPlugin struct {
+	client *api.Client
+}
+
+// NewLDAPPlugin creates a new LDAP plugin
+func NewLDAPPlugin(client *api.Client) AuthInterface {
+	return &authLDAPPlugin{
+		client: client,
+	}
+}
+
+// Create logs in with the username and password provided in the file or environment
+func (r authLDAPPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	// step: extract the options
+	if cfg.Username == "" {
+		cfg.Username = os.Getenv("VAULT_SIDEKICK_USERNAME")
+	}
+	if cfg.Password == "" {
+		cfg.Password = os.Getenv("VAULT_SIDEKICK_PASSWORD")
+	}
+	if cfg.Username == "" {
+		return nil, permanent(fmt.Errorf("no username provided for the ldap authentication"))
+	}
+	loginPath := cfg.loginPath("ldap", "VAULT_LDAP_LOGIN_PATH")
+
+	secret, err := r.client.Logical().Write(fmt.Sprintf("%s/%s", loginPath, cfg.Username), map[string]interface{}{
+		"password": cfg.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return authFromSecret(secret)
+}
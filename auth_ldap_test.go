@@ -0,0 +1,60 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLDAPPlugin(t *testing.T) {
+	var login map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/ldap/login/jdoe", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60, "renewable": true}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	auth, err := NewLDAPPlugin(client).Create(&vaultAuthOptions{Username: "jdoe", Password: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, map[string]string{"password": "secret"}, login)
+
+	// step: the credentials can be taken from the environment
+	login = nil
+	t.Setenv("VAULT_SIDEKICK_USERNAME", "jdoe")
+	t.Setenv("VAULT_SIDEKICK_PASSWORD", "from-env")
+	_, err = NewLDAPPlugin(client).Create(&vaultAuthOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"password": "from-env"}, login)
+}
+
+func TestLDAPPluginWithoutUsername(t *testing.T) {
+	t.Setenv("VAULT_SIDEKICK_USERNAME", "")
+	client := newTestVaultClient(t, http.NewServeMux())
+
+	_, err := NewLDAPPlugin(client).Create(&vaultAuthOptions{Password: "secret"})
+	assert.Error(t, err)
+	assert.True(t, isPermanentError(err))
+}
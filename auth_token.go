@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/hashicorp/vault/api"
 )
@@ -28,44 +29,71 @@ import (
 type authTokenPlugin struct {
 	// the vault client
 	client *api.Client
+	// the tokens already unwrapped
+	unwrapped *unwrapCache
 }
 
 // NewUserTokenPlugin creates a new User Token plugin
-func NewUserTokenPlugin(client *api.Client) AuthInterface {
+func NewUserTokenPlugin(client *api.Client, unwrapped *unwrapCache) AuthInterface {
 	return &authTokenPlugin{
-		client: client,
+		client:    client,
+		unwrapped: unwrapped,
 	}
 }
 
 // Create retrieves the token from an environment variable or file
-func (r authTokenPlugin) Create(cfg *vaultAuthOptions) (string, error) {
+func (r authTokenPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
+	// step: check for a response-wrapped token
+	wrapped, err := readWrappedValue(cfg.WrappedToken, cfg.WrappedTokenFile, "VAULT_SIDEKICK_WRAPPED_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if wrapped != "" {
+		creationPaths := []string{"auth/token/create", "auth/token/create-orphan", "auth/token/create/*"}
+		token, err := unwrapCredential(r.client, cfg, r.unwrapped, wrapped, creationPaths, func(secret *api.Secret) (string, error) {
+			if secret.Auth == nil || secret.Auth.ClientToken == "" {
+				return "", fmt.Errorf("the unwrapped response does not contain a token")
+			}
+			return secret.Auth.ClientToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return lookupTokenAuth(r.client, token)
+	}
+
 	if cfg.FileName != "" {
 		content, err := readConfigFile(cfg.FileName, cfg.FileFormat)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		// check: ensure we have a token in the file
 		token := content.Token
 		if token == "" {
-			return "", fmt.Errorf("the auth file: %s does not contain a token", cfg.FileName)
+			return nil, fmt.Errorf("the auth file: %s does not contain a token", cfg.FileName)
 		}
 
-		return token, nil
+		return lookupTokenAuth(r.client, token)
 	}
 
 	// step: check the VAULT_TOKEN
 	if val := os.Getenv("VAULT_TOKEN"); val != "" {
-		return val, nil
+		return lookupTokenAuth(r.client, val)
 	}
 
 	// step: check the VAULT_TOKEN_FILE
 	if filepath := os.Getenv("VAULT_TOKEN_FILE"); filepath != "" {
 		content, err := ioutil.ReadFile(filepath)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return nil, fmt.Errorf("the token file: %s is empty", filepath)
 		}
-		return string(content), nil
+		return lookupTokenAuth(r.client, token)
 	}
 
-	return "", fmt.Errorf("no token provided")
+	return nil, permanent(fmt.Errorf("no token provided"))
 }
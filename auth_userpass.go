@@ -41,7 +41,7 @@ func NewUserPassPlugin(client *api.Client) AuthInterface {
 }
 
 // Create a userpass plugin with the username and password provide in the file
-func (r authUserPassPlugin) Create(cfg *vaultAuthOptions) (string, error) {
+func (r authUserPassPlugin) Create(cfg *vaultAuthOptions) (*api.SecretAuth, error) {
 	// step: extract the options
 	if cfg.Username == "" {
 		cfg.Username = os.Getenv("VAULT_SIDEKICK_USERNAME")
@@ -51,22 +51,23 @@ func (r authUserPassPlugin) Create(cfg *vaultAuthOptions) (string, error) {
 	}
 
 	// step: create the token request
-	request := r.client.NewRequest("POST", fmt.Sprintf("/v1/auth/userpass/login/%s", cfg.Username))
+	loginPath := cfg.loginPath("userpass", "VAULT_USERPASS_LOGIN_PATH")
+	request := r.client.NewRequest("POST", fmt.Sprintf("/v1/%s/%s", loginPath, cfg.Username))
 	if err := request.SetJSONBody(userPassLogin{Password: cfg.Password}); err != nil {
-		return "", err
+		return nil, err
 	}
 	// step: make the request
 	resp, err := r.client.RawRequest(request)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// step: parse and return auth
 	secret, err := api.ParseSecret(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return secret.Auth.ClientToken, nil
+	return authFromSecret(secret)
 }
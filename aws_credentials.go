@@ -0,0 +1,436 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// defaultAWSMetadataURL is the address of the ec2 instance metadata service
+	defaultAWSMetadataURL = "http://169.254.169.254"
+	// defaultAWSContainerURL is the address of the ecs container credentials endpoint
+	defaultAWSContainerURL = "http://169.254.170.2"
+	// defaultAWSSTSEndpoint is the global sts endpoint, which is what vault verifies against by default
+	defaultAWSSTSEndpoint = "https://sts.amazonaws.com"
+	// defaultAWSRegion is the region used to sign requests to the global sts endpoint
+	defaultAWSRegion = "us-east-1"
+)
+
+// awsCredentials are a set of aws credentials used to sign requests
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// the name of the provider which supplied the credentials
+	Source string
+}
+
+// awsCredentialChain retrieves the aws credentials in the same order as the aws sdk; environment variables,
+// web identity, shared credentials file, container credentials and finally the instance metadata service
+type awsCredentialChain struct {
+	// the base url of the instance metadata service
+	metadataURL string
+	// the sts endpoint used to exchange a web identity token
+	stsEndpoint string
+	// the http client
+	client *http.Client
+}
+
+// newAWSCredentialChain creates a credential chain
+func newAWSCredentialChain(metadataURL, stsEndpoint string) *awsCredentialChain {
+	return &awsCredentialChain{
+		metadataURL: strings.TrimSuffix(metadataURL, "/"),
+		stsEndpoint: strings.TrimSuffix(stsEndpoint, "/"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Retrieve walks the chain and returns the first credentials found
+func (r *awsCredentialChain) Retrieve() (*awsCredentials, error) {
+	providers := []struct {
+		name     string
+		retrieve func() (*awsCredentials, error)
+	}{
+		{name: "environment", retrieve: r.fromEnvironment},
+		{name: "web-identity", retrieve: r.fromWebIdentity},
+		{name: "shared-credentials", retrieve: r.fromSharedCredentials},
+		{name: "container", retrieve: r.fromContainer},
+		{name: "instance-metadata", retrieve: r.fromInstanceMetadata},
+	}
+
+	var errs []string
+	for _, provider := range providers {
+		creds, err := provider.retrieve()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", provider.name, err))
+			continue
+		}
+		if creds == nil {
+			continue
+		}
+		creds.Source = provider.name
+		glog.V(3).Infof("retrieved the aws credentials from the %s provider", provider.name)
+
+		return creds, nil
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("unable to retrieve aws credentials, %s", strings.Join(errs, ", "))
+	}
+
+	return nil, fmt.Errorf("unable to find any aws credentials")
+}
+
+// fromEnvironment retrieves the credentials from the standard environment variables
+func (r *awsCredentialChain) fromEnvironment() (*awsCredentials, error) {
+	accessKey := getEnv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY"))
+	secretKey := getEnv("AWS_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_KEY"))
+	if accessKey == "" || secretKey == "" {
+		return nil, nil
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+// fromWebIdentity exchanges a web identity token (i.e. eks service account) for credentials
+func (r *awsCredentialChain) fromWebIdentity() (*awsCredentials, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := getEnv("AWS_ROLE_SESSION_NAME", fmt.Sprintf("%s-%d", prog, time.Now().Unix()))
+
+	values := url.Values{}
+	values.Set("Action", "AssumeRoleWithWebIdentity")
+	values.Set("Version", "2011-06-15")
+	values.Set("RoleArn", roleARN)
+	values.Set("RoleSessionName", sessionName)
+	values.Set("WebIdentityToken", string(bytes.TrimSpace(token)))
+
+	resp, err := r.client.PostForm(r.stsEndpoint+"/", values)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sts returned status: %d, response: %s", resp.StatusCode, content)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+	}, nil
+}
+
+// fromSharedCredentials reads the profile from the shared credentials file
+func (r *awsCredentialChain) fromSharedCredentials() (*awsCredentials, error) {
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	if exists, _ := fileExists(filename); !exists {
+		return nil, nil
+	}
+	profile := getEnv("AWS_PROFILE", "default")
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	creds := &awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+
+	return creds, nil
+}
+
+// fromContainer retrieves the credentials from the ecs / eks pod identity endpoint
+func (r *awsCredentialChain) fromContainer() (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = defaultAWSContainerURL + uri
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if filename := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		token = string(bytes.TrimSpace(content))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+
+	return r.getJSONCredentials(request)
+}
+
+// fromInstanceMetadata retrieves the credentials of the instance profile from the metadata service
+func (r *awsCredentialChain) fromInstanceMetadata() (*awsCredentials, error) {
+	path := "/latest/meta-data/iam/security-credentials/"
+	content, err := getAWSMetadata(r.client, r.metadataURL, path)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+	if role == "" {
+		return nil, fmt.Errorf("no instance profile associated to the instance")
+	}
+	request, err := newAWSMetadataRequest(r.client, r.metadataURL, path+role)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getJSONCredentials(request)
+}
+
+// getJSONCredentials performs the request and decodes the credentials
+func (r *awsCredentialChain) getJSONCredentials(request *http.Request) (*awsCredentials, error) {
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("credentials endpoint returned status: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.AccessKeyID == "" || result.SecretAccessKey == "" {
+		return nil, fmt.Errorf("credentials endpoint returned no credentials")
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.AccessKeyID,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.Token,
+	}, nil
+}
+
+// newAWSMetadataRequest creates a request to the instance metadata service, using a session token (IMDSv2)
+// when the service supports it
+func newAWSMetadataRequest(client *http.Client, metadataURL, path string) (*http.Request, error) {
+	request, err := http.NewRequest("GET", metadataURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenRequest, err := http.NewRequest("PUT", metadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(tokenRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		token, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("X-aws-ec2-metadata-token", string(token))
+	}
+
+	return request, nil
+}
+
+// getAWSMetadata retrieves a path from the instance metadata service
+func getAWSMetadata(client *http.Client, metadataURL, path string) ([]byte, error) {
+	request, err := newAWSMetadataRequest(client, metadataURL, path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned status: %d for path: %s", resp.StatusCode, path)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// signAWSRequest signs the request using aws signature version 4
+func signAWSRequest(request *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if request.Header.Get("Host") == "" {
+		request.Header.Set("Host", request.URL.Host)
+	}
+
+	// step: build the canonical headers
+	var names []string
+	headers := make(map[string]string)
+	for name, values := range request.Header {
+		lower := strings.ToLower(name)
+		names = append(names, lower)
+		var trimmed []string
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[lower] = strings.Join(trimmed, ",")
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := request.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		uri,
+		strings.Replace(request.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	// step: build the string to sign and derive the signing key
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 computes the hmac of the data with the key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -21,6 +21,9 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -38,6 +41,31 @@ type vaultAuthOptions struct {
 	FileFormat    string
 	Username      string
 	Password      string
+
+	Mount       string `json:"mount" yaml:"mount"`
+	Role        string `json:"role" yaml:"role"`
+	JWT         string `json:"jwt" yaml:"jwt"`
+	JWTFile     string `json:"jwt_file" yaml:"jwt_file"`
+	TokenPath   string `json:"token_path" yaml:"token_path"`
+	Audience    string `json:"audience" yaml:"audience"`
+	IAMServerID string `json:"iam_server_id" yaml:"iam_server_id"`
+	Region      string `json:"region" yaml:"region"`
+	MetadataURL string `json:"metadata_url" yaml:"metadata_url"`
+	STSEndpoint string `json:"sts_endpoint" yaml:"sts_endpoint"`
+	Resource    string `json:"resource" yaml:"resource"`
+	ClientID    string `json:"client_id" yaml:"client_id"`
+	GitHubToken string `json:"github_token" yaml:"github_token"`
+
+	// the response-wrapped credentials
+	WrappedSecretID     string `json:"wrapped_secret_id" yaml:"wrapped_secret_id"`
+	WrappedSecretIDFile string `json:"wrapped_secret_id_file" yaml:"wrapped_secret_id_file"`
+	WrappedToken        string `json:"wrapped_token" yaml:"wrapped_token"`
+	WrappedTokenFile    string `json:"wrapped_token_file" yaml:"wrapped_token_file"`
+	WrappingPath        string `json:"wrapping_path" yaml:"wrapping_path"`
+
+	// the aws ec2 client nonce file and the identity document to login with
+	NonceFile        string `json:"nonce_file" yaml:"nonce_file"`
+	IdentityDocument string `json:"identity_document" yaml:"identity_document"`
 }
 
 type config struct {
@@ -53,12 +81,20 @@ type config struct {
 	vaultRenewToken bool
 	// the vault ca file
 	vaultCaFile string
+	// the vault enterprise namespace to authenticate in
+	vaultNamespace string
+	// the client certificate presented to vault
+	vaultClientCert string
+	// the private key of the client certificate
+	vaultClientKey string
 	// the place to write the resources
 	outputDir string
 	// switch on dry run
 	dryRun bool
 	// skip tls verify
 	skipTLSVerify bool
+	// the interval to check the auth file and credential files for changes
+	authReloadInterval time.Duration
 	// the resource items to retrieve
 	resources *VaultResources
 	// the interval for producing statistics
@@ -69,10 +105,25 @@ type config struct {
 	showVersion bool
 	// one-shot mode
 	oneShot bool
+	// the file to write the vault token to
+	tokenSink string
+	// the file permissions on the token sink
+	tokenSinkMode os.FileMode
+	// the format of the token sink, token or json
+	tokenSinkFormat string
+	// response-wrap the token written to the sink with this ttl
+	tokenSinkWrapTTL time.Duration
+	// login, write the token to the sink and exit
+	requestToken bool
+	// the file permissions on the token sink as given
+	tokenSinkModeValue string
 }
 
 var (
 	options config
+	// authPlugins are the authentication methods supported
+	authPlugins = []string{"userpass", "ldap", "github", "approle", "aws-ec2", "aws-iam", "gcp-gce", "azure",
+		"kubernetes", "jwt", "cert", "token"}
 )
 
 func init() {
@@ -85,17 +136,26 @@ func init() {
 
 	flag.StringVar(&options.vaultURL, "vault", getEnv("VAULT_ADDR", "https://127.0.0.1:8200"), "url the vault service or VAULT_ADDR")
 	flag.StringVar(&options.vaultAuthFile, "auth", getEnv("AUTH_FILE", ""), "a configuration file in json or yaml containing authentication arguments")
+	flag.DurationVar(&options.authReloadInterval, "auth-reload-interval", 10*time.Second, "the interval to check the auth file and credential files for changes, zero disables")
 	flag.BoolVar(&options.vaultRenewToken, "renew-token", false, "renew vault token according to its ttl")
 	flag.StringVar(&options.vaultAuthFileFormat, "format", getEnv("AUTH_FORMAT", "default"), "the auth file format")
 	flag.StringVar(&options.outputDir, "output", getEnv("VAULT_OUTPUT", "/etc/secrets"), "the full path to write resources or VAULT_OUTPUT")
 	flag.BoolVar(&options.dryRun, "dryrun", false, "perform a dry run, printing the content to screen")
 	flag.BoolVar(&options.skipTLSVerify, "tls-skip-verify", false, "whether to check and verify the vault service certificate")
 	flag.StringVar(&options.vaultCaFile, "ca-cert", "", "the path to the file container the CA used to verify the vault service")
+	flag.StringVar(&options.vaultNamespace, "namespace", getEnv("VAULT_NAMESPACE", ""), "the vault enterprise namespace to authenticate in or VAULT_NAMESPACE")
+	flag.StringVar(&options.vaultClientCert, "client-cert", getEnv("VAULT_CLIENT_CERT", ""), "the path to a client certificate presented to the vault service or VAULT_CLIENT_CERT")
+	flag.StringVar(&options.vaultClientKey, "client-key", getEnv("VAULT_CLIENT_KEY", ""), "the path to the private key of the client certificate or VAULT_CLIENT_KEY")
 	flag.DurationVar(&options.statsInterval, "stats", time.Duration(1)*time.Hour, "the interval to produce statistics on the accessed resources")
 	flag.DurationVar(&options.execTimeout, "exec-timeout", time.Duration(60)*time.Second, "the timeout applied to commands on the exec option")
 	flag.BoolVar(&options.showVersion, "version", false, "show the vault-sidekick version")
 	flag.Var(options.resources, "cn", "a resource to retrieve and monitor from vault")
 	flag.BoolVar(&options.oneShot, "one-shot", false, "retrieve resources from vault once and then exit")
+	flag.StringVar(&options.tokenSink, "token-sink", getEnv("VAULT_TOKEN_SINK", ""), "the full path of a file to write the vault token to, rewritten whenever the token changes")
+	flag.StringVar(&options.tokenSinkModeValue, "token-sink-mode", "0600", "the file permissions on the token sink")
+	flag.StringVar(&options.tokenSinkFormat, "token-sink-format", "token", "the format of the token sink, token or json (with accessor and expiry)")
+	flag.DurationVar(&options.tokenSinkWrapTTL, "token-sink-wrap-ttl", 0, "response-wrap the token written to the sink with the ttl")
+	flag.BoolVar(&options.requestToken, "request-token", false, "request an authentication token from vault, write it to the token sink and exit")
 }
 
 // parseOptions validate the command line options and validates them
@@ -126,6 +186,12 @@ func validateOptions(cfg *config) (err error) {
 		cfg.vaultURL = os.Getenv("VAULT_ADDR")
 	}
 
+	if cfg.vaultAuthOptions != nil {
+		if err := validateAuthMount(cfg.vaultAuthOptions); err != nil {
+			return err
+		}
+	}
+
 	if cfg.vaultURL == "" {
 		return fmt.Errorf("VAULT_ADDR is unset")
 	}
@@ -141,9 +207,136 @@ func validateOptions(cfg *config) (err error) {
 		}
 	}
 
+	if (cfg.vaultClientCert == "") != (cfg.vaultClientKey == "") {
+		return fmt.Errorf("the client certificate and key must be specified together")
+	}
+	if cfg.vaultAuthOptions != nil && contains("cert", authMethods(cfg.vaultAuthOptions.Method)) && cfg.vaultClientCert == "" {
+		return fmt.Errorf("the cert authentication method requires the client certificate and key (-client-cert, -client-key)")
+	}
+	for _, filename := range []string{cfg.vaultClientCert, cfg.vaultClientKey} {
+		if filename == "" {
+			continue
+		}
+		if exists, _ := fileExists(filename); !exists {
+			return fmt.Errorf("the client certificate file: %s does not exist", filename)
+		}
+	}
+
+	if err := validateTokenSink(cfg); err != nil {
+		return err
+	}
+
 	if cfg.skipTLSVerify == true && cfg.vaultCaFile != "" {
 		return fmt.Errorf("you are skipping the tls but supplying a CA, doesn't make sense")
 	}
 
 	return nil
 }
+
+// validateAuthMount defaults and validates the mount and login path of the authentication method
+func validateAuthMount(opts *vaultAuthOptions) error {
+	if opts.Mount == "" {
+		opts.Mount = os.Getenv("VAULT_AUTH_MOUNT")
+	}
+	if opts.LoginPath == "" {
+		opts.LoginPath = os.Getenv("VAULT_AUTH_LOGIN_PATH")
+	}
+	if opts.Mount != "" && opts.LoginPath != "" {
+		return fmt.Errorf("the auth mount: %s and login path: %s are mutually exclusive", opts.Mount, opts.LoginPath)
+	}
+	for _, method := range authMethods(opts.Method) {
+		if !contains(method, authPlugins) {
+			return fmt.Errorf("unsupported authentication method: %s, should be one of: %s", method, strings.Join(authPlugins, ", "))
+		}
+	}
+	if len(authMethods(opts.Method)) > 1 && (opts.Mount != "" || opts.LoginPath != "") {
+		return fmt.Errorf("the auth mount and login path cannot be used with a chain of methods: %s, use the method specific login paths", opts.Method)
+	}
+	if opts.Mount != "" {
+		mount := strings.Trim(opts.Mount, "/")
+		if mount == "" || strings.ContainsAny(mount, " ?#") || path.Clean(mount) != mount || strings.HasPrefix(mount, "..") {
+			return fmt.Errorf("invalid auth mount: '%s', should be the path of the auth method i.e. approle", opts.Mount)
+		}
+	}
+	if opts.LoginPath != "" {
+		if !strings.HasPrefix(normalizeLoginPath(opts.LoginPath), "auth/") {
+			return fmt.Errorf("invalid login path: '%s', should be of the form auth/MOUNT/login", opts.LoginPath)
+		}
+	}
+
+	return nil
+}
+
+// authMethods splits the authentication method option into the ordered list of methods to try
+func authMethods(method string) []string {
+	var methods []string
+	for _, m := range strings.Split(method, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			methods = append(methods, m)
+		}
+	}
+
+	return methods
+}
+
+// loginPath returns the logical path used to login with the authentication method; the login path and mount
+// options take precedence over the plugin specific environment variable (env) and the default mount
+func (o *vaultAuthOptions) loginPath(defaultMount, env string) string {
+	if o.LoginPath != "" {
+		return normalizeLoginPath(o.LoginPath)
+	}
+	if o.Mount != "" {
+		return path.Join("auth", strings.TrimPrefix(strings.Trim(o.Mount, "/"), "auth/"), "login")
+	}
+	if v := os.Getenv(env); env != "" && v != "" {
+		return normalizeLoginPath(v)
+	}
+
+	return path.Join("auth", defaultMount, "login")
+}
+
+// normalizeLoginPath converts a login path into the logical path of the login endpoint
+func normalizeLoginPath(loginPath string) string {
+	loginPath = strings.Trim(loginPath, "/")
+	loginPath = strings.TrimPrefix(loginPath, "v1/")
+	if !strings.HasSuffix(loginPath, "/login") {
+		loginPath = loginPath + "/login"
+	}
+
+	return loginPath
+}
+
+// validateTokenSink validates the token sink options
+func validateTokenSink(cfg *config) error {
+	if cfg.requestToken && cfg.tokenSink == "" {
+		return fmt.Errorf("the request token option requires a token sink")
+	}
+	if cfg.tokenSink == "" {
+		return nil
+	}
+	switch cfg.tokenSinkFormat {
+	case "", "token":
+		cfg.tokenSinkFormat = "token"
+	case "json":
+	default:
+		return fmt.Errorf("unsupported token sink format: %s, should be token or json", cfg.tokenSinkFormat)
+	}
+	if cfg.tokenSinkWrapTTL < 0 {
+		return fmt.Errorf("the token sink wrap ttl cannot be negative")
+	}
+
+	value := cfg.tokenSinkModeValue
+	if value == "" {
+		value = "0600"
+	}
+	if !strings.HasPrefix(value, "0") {
+		value = "0" + value
+	}
+	mode, err := strconv.ParseUint(value, 0, 32)
+	if err != nil || len(value) != 4 {
+		return fmt.Errorf("the token sink permissions: %s are invalid, should be octal 0600 or alike", cfg.tokenSinkModeValue)
+	}
+	cfg.tokenSinkMode = os.FileMode(mode)
+
+	return nil
+}
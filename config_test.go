@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -75,3 +76,116 @@ func TestValidateOptionsWithVaultURLFromAuthFile(t *testing.T) {
 		t.Errorf("Expected Vault URL to be %s got %s", expected, actual)
 	}
 }
+
+func TestValidateOptionsWithAuthMount(t *testing.T) {
+	cfg := &config{
+		vaultURL:         "http://testurl:8080",
+		vaultAuthOptions: &vaultAuthOptions{Method: "approle", Mount: "approle-prod", LoginPath: "auth/approle/login"},
+	}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error, mount and login path are mutually exclusive")
+	}
+
+	for _, mount := range []string{"/", "../approle", "app role"} {
+		cfg.vaultAuthOptions = &vaultAuthOptions{Method: "approle", Mount: mount}
+		if err := validateOptions(cfg); err == nil {
+			t.Errorf("should have raised error on mount: %s", mount)
+		}
+	}
+
+	cfg.vaultAuthOptions = &vaultAuthOptions{Method: "approle", LoginPath: "/v1/approle/login"}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error on a login path outside auth/")
+	}
+
+	cfg.vaultAuthOptions = &vaultAuthOptions{Method: "approle", Mount: "/approle-prod/"}
+	if err := validateOptions(cfg); err != nil {
+		t.Errorf("raised an error: %v", err)
+	}
+
+	cfg.vaultAuthOptions = &vaultAuthOptions{Method: "kubernetes,approle", Mount: "approle-prod"}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error, a mount cannot be used with a chain of methods")
+	}
+}
+
+func TestValidateOptionsWithAuthMethod(t *testing.T) {
+	cfg := &config{vaultURL: "http://testurl:8080"}
+	for _, method := range []string{"nosuch", "kubernetes,nosuch", "app-role"} {
+		cfg.vaultAuthOptions = &vaultAuthOptions{Method: method}
+		if err := validateOptions(cfg); err == nil {
+			t.Errorf("should have raised error on method: %s", method)
+		}
+	}
+
+	cfg.vaultAuthOptions = &vaultAuthOptions{Method: "kubernetes, approle,token"}
+	if err := validateOptions(cfg); err != nil {
+		t.Errorf("raised an error: %v", err)
+	}
+}
+
+func TestValidateOptionsWithCertMethod(t *testing.T) {
+	cfg := &config{
+		vaultURL:         "http://testurl:8080",
+		vaultAuthOptions: &vaultAuthOptions{Method: "kubernetes,cert"},
+	}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error, the cert method requires a client certificate")
+	}
+
+	dir := t.TempDir()
+	cfg.vaultClientCert = filepath.Join(dir, "client.crt")
+	cfg.vaultClientKey = filepath.Join(dir, "client.key")
+	for _, filename := range []string{cfg.vaultClientCert, cfg.vaultClientKey} {
+		if err := os.WriteFile(filename, []byte("pem"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := validateOptions(cfg); err != nil {
+		t.Errorf("raised an error: %v", err)
+	}
+}
+
+func TestAuthLoginPath(t *testing.T) {
+	os.Setenv("VAULT_K8S_LOGIN_PATH", "")
+	cases := []struct {
+		Options  vaultAuthOptions
+		Env      string
+		Expected string
+	}{
+		{Expected: "auth/kubernetes/login"},
+		{Options: vaultAuthOptions{Mount: "k8s-prod"}, Expected: "auth/k8s-prod/login"},
+		{Options: vaultAuthOptions{Mount: "/clusters/prod/"}, Expected: "auth/clusters/prod/login"},
+		{Options: vaultAuthOptions{LoginPath: "/v1/auth/k8s/login"}, Expected: "auth/k8s/login"},
+		{Env: "/v1/auth/k8s-env/login", Expected: "auth/k8s-env/login"},
+		{Env: "/v1/auth/k8s-env", Expected: "auth/k8s-env/login"},
+		{Options: vaultAuthOptions{Mount: "k8s-file"}, Env: "/v1/auth/k8s-env/login", Expected: "auth/k8s-file/login"},
+	}
+	for i, c := range cases {
+		os.Setenv("VAULT_K8S_LOGIN_PATH", c.Env)
+		if actual := c.Options.loginPath("kubernetes", "VAULT_K8S_LOGIN_PATH"); actual != c.Expected {
+			t.Errorf("case %d, expected login path: %s, got: %s", i, c.Expected, actual)
+		}
+	}
+	os.Setenv("VAULT_K8S_LOGIN_PATH", "")
+}
+
+func TestValidateOptionsWithTokenSink(t *testing.T) {
+	cfg := &config{vaultURL: "http://testurl:8080", requestToken: true}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error, request token requires a sink")
+	}
+
+	cfg = &config{vaultURL: "http://testurl:8080", tokenSink: "/tmp/token", tokenSinkFormat: "xml"}
+	if err := validateOptions(cfg); err == nil {
+		t.Errorf("should have raised error on the format")
+	}
+
+	cfg = &config{vaultURL: "http://testurl:8080", tokenSink: "/tmp/token", tokenSinkModeValue: "440"}
+	if err := validateOptions(cfg); err != nil {
+		t.Errorf("raised an error: %v", err)
+	}
+	if cfg.tokenSinkMode != os.FileMode(0440) || cfg.tokenSinkFormat != "token" {
+		t.Errorf("expected mode 0440 and format token, got: %s, %s", cfg.tokenSinkMode, cfg.tokenSinkFormat)
+	}
+}
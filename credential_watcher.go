@@ -0,0 +1,129 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// credentialWatcher polls the auth file and the credential files, logging in again when they change
+type credentialWatcher struct {
+	// the token manager
+	tokens *tokenManager
+	// the configuration
+	opts *config
+	// the checksums of the files when last used to login
+	checksums map[string][sha256.Size]byte
+}
+
+// newCredentialWatcher creates a watcher, taking the current content of the files as already in use
+func newCredentialWatcher(tokens *tokenManager, opts *config) *credentialWatcher {
+	r := &credentialWatcher{
+		tokens:    tokens,
+		opts:      opts,
+		checksums: make(map[string][sha256.Size]byte),
+	}
+	r.checksums, _ = r.changed()
+
+	return r
+}
+
+// run checks the files on every interval
+func (r *credentialWatcher) run(interval time.Duration) {
+	glog.V(3).Infof("watching the credential files: %v for changes every %s", r.files(), interval)
+	for {
+		time.Sleep(interval)
+		if err := r.check(); err != nil {
+			glog.Errorf("failed to re-authenticate after the credentials changed, keeping the current token, error: %s", err)
+		}
+	}
+}
+
+// check logs in again if any of the files have changed; on failure the files are checked again on the next call
+func (r *credentialWatcher) check() error {
+	checksums, changed := r.changed()
+	if len(changed) == 0 {
+		return nil
+	}
+	glog.Infof("the credential files: %v have changed", changed)
+
+	var auth *vaultAuthOptions
+	if r.opts.vaultAuthFile != "" && contains(r.opts.vaultAuthFile, changed) {
+		var err error
+		auth, err = readConfigFile(r.opts.vaultAuthFile, r.opts.vaultAuthFileFormat)
+		if err != nil {
+			return fmt.Errorf("unable to read in authentication options from: %s, error: %s", r.opts.vaultAuthFile, err)
+		}
+		if err := validateAuthMount(auth); err != nil {
+			return err
+		}
+	}
+	if err := r.tokens.Reload(auth); err != nil {
+		return err
+	}
+	r.checksums = checksums
+
+	return nil
+}
+
+// changed returns the checksums of the files and the files which differ from those last used; files which
+// can't be read, i.e. in the middle of being replaced, are ignored
+func (r *credentialWatcher) changed() (map[string][sha256.Size]byte, []string) {
+	checksums := make(map[string][sha256.Size]byte)
+	var changed []string
+	for _, filename := range r.files() {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			glog.V(4).Infof("unable to read the credential file: %s, error: %s", filename, err)
+			if checksum, found := r.checksums[filename]; found {
+				checksums[filename] = checksum
+			}
+			continue
+		}
+		checksum := sha256.Sum256(content)
+		if previous, found := r.checksums[filename]; !found || previous != checksum {
+			changed = append(changed, filename)
+		}
+		checksums[filename] = checksum
+	}
+
+	return checksums, changed
+}
+
+// files returns the files holding credentials used to login
+func (r *credentialWatcher) files() []string {
+	auth := r.tokens.AuthOptions()
+	var files []string
+	for _, filename := range []string{
+		r.opts.vaultAuthFile,
+		os.Getenv("VAULT_TOKEN_FILE"),
+		auth.WrappedSecretIDFile,
+		auth.WrappedTokenFile,
+	} {
+		if filename != "" && !contains(filename, files) {
+			files = append(files, filename)
+		}
+	}
+
+	return files
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTokenLookup(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") == "bad" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"ttl": 3600, "renewable": false}}`)
+	})
+	return mux
+}
+
+func TestCredentialWatcherTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("tok1\n"), 0600))
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_TOKEN_FILE", tokenFile)
+
+	client := newTestVaultClient(t, newTestTokenLookup(t))
+	manager := newTokenManager(client, &config{vaultAuthOptions: &vaultAuthOptions{Method: "token"}})
+	require.NoError(t, manager.Login())
+	assert.Equal(t, "tok1", manager.Current().Auth.ClientToken)
+
+	watcher := newCredentialWatcher(manager, manager.opts)
+	require.NoError(t, watcher.check())
+	assert.Equal(t, "tok1", manager.Current().Auth.ClientToken)
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("tok2\n"), 0600))
+	require.NoError(t, watcher.check())
+	assert.Equal(t, "tok2", manager.Current().Auth.ClientToken)
+	assert.Equal(t, "tok2", client.Token())
+}
+
+func TestCredentialWatcherAuthFile(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`{"method": "token", "token": "tok1"}`), 0600))
+	t.Setenv("VAULT_TOKEN_FILE", "")
+
+	client := newTestVaultClient(t, newTestTokenLookup(t))
+	opts := &config{vaultAuthFile: authFile, vaultAuthFileFormat: "default"}
+	opts.vaultAuthOptions, _ = readConfigFile(authFile, "default")
+	manager := newTokenManager(client, opts)
+	require.NoError(t, manager.Login())
+	watcher := newCredentialWatcher(manager, opts)
+
+	// step: a failed login keeps the current token and is retried on the next check
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`{"method": "token", "token": "bad"}`), 0600))
+	assert.Error(t, watcher.check())
+	assert.Equal(t, "tok1", manager.Current().Auth.ClientToken)
+	assert.Equal(t, "tok1", client.Token())
+
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`{"method": "token", "token": "tok2"}`), 0600))
+	require.NoError(t, watcher.check())
+	assert.Equal(t, "tok2", manager.Current().Auth.ClientToken)
+	assert.NoError(t, watcher.check())
+}
@@ -18,11 +18,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 
@@ -158,6 +161,75 @@ func writeCertificateBundleFile(filename string, data map[string]interface{}, mo
 	return nil
 }
 
+// writeKeystoreFile writes the certificate and private key as a pkcs12 or java keystore, along with a truststore of the
+// issuing ca and ca chain; a resource without a private key, i.e. a ca bundle, only has the truststore
+func writeKeystoreFile(filename string, data map[string]interface{}, mode os.FileMode, resource, format, alias string) error {
+	password, _ := data[keystorePasswordKey].(string)
+	if password == "" {
+		return errNoKeystorePassword
+	}
+	if alias == "" {
+		alias = defaultKeystoreAlias
+	}
+	encodeKeystore, encodeTruststore, suffix := encodePKCS12Keystore, encodePKCS12Truststore, "p12"
+	if format == "jks" {
+		encodeKeystore, encodeTruststore, suffix = encodeJavaKeystore, encodeJavaTruststore, "jks"
+	}
+
+	// step: gather the unique ca certificates, the chain includes the issuing ca
+	var trusted []*x509.Certificate
+	seen := make(map[[sha256.Size]byte]bool)
+	content := []string{fmt.Sprintf("%v", data["issuing_ca"])}
+	// step: only the content of a ca bundle holds certificates, for any other resource it's a field of the secret
+	if resource == "pki-ca" {
+		content = append(content, fmt.Sprintf("%v", data["content"]))
+	}
+	if chain, ok := data["ca_chain"].([]interface{}); ok {
+		for _, x := range chain {
+			content = append(content, fmt.Sprintf("%v", x))
+		}
+	}
+	for _, certificate := range parsePEMCertificates([]byte(strings.Join(content, "\n"))) {
+		if fingerprint := sha256.Sum256(certificate.Raw); !seen[fingerprint] {
+			seen[fingerprint] = true
+			trusted = append(trusted, certificate)
+		}
+	}
+
+	if privateKey, found := data["private_key"]; found {
+		certificates := parsePEMCertificates([]byte(fmt.Sprintf("%v", data["certificate"])))
+		if len(certificates) == 0 {
+			return fmt.Errorf("the resource has no certificate for the private key")
+		}
+		key, err := parsePrivateKey([]byte(fmt.Sprintf("%v", privateKey)))
+		if err != nil {
+			return err
+		}
+		keystore, err := encodeKeystore(alias, key, append(certificates[:1], trusted...), password)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(fmt.Sprintf("%s.%s", filename, suffix), keystore, mode); err != nil {
+			glog.Errorf("failed to write the keystore file, error: %s", err)
+			return err
+		}
+	}
+	if len(trusted) == 0 {
+		glog.Warningf("the resource: %s has no ca certificates for the truststore", filename)
+		return nil
+	}
+	truststore, err := encodeTruststore(alias, trusted, password)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fmt.Sprintf("%s-truststore.%s", filename, suffix), truststore, mode); err != nil {
+		glog.Errorf("failed to write the truststore file, error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
 func writeCredentialFile(filename string, data map[string]interface{}, mode os.FileMode) error {
 	privateKeyData := fmt.Sprintf("%s", data["private_key_data"])
 	key, err := base64.StdEncoding.DecodeString(privateKeyData)
@@ -256,3 +328,36 @@ func writeFile(filename string, content []byte, mode os.FileMode) error {
 
 	return ioutil.WriteFile(filename, content, mode)
 }
+
+// writeFileAtomic writes the file to a temporary file alongside it and renames it into place, so a reader never sees
+// a partially written file
+func writeFileAtomic(filename string, content []byte, mode os.FileMode) error {
+	if options.dryRun {
+		glog.Infof("dry-run: filename: %s, %d bytes", filename, len(content))
+		return nil
+	}
+	glog.V(3).Infof("saving the file: %s", filename)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
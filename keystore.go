@@ -0,0 +1,548 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// defaultKeystoreAlias is the alias of the certificate in a keystore when none is given
+	defaultKeystoreAlias = "vault-sidekick"
+	// defaultKeystorePasswordEnv is the environment variable holding the keystore password when none is given
+	defaultKeystorePasswordEnv = "VAULT_SIDEKICK_KEYSTORE_PASSWORD"
+	// keystorePasswordKey is the key of the resolved keystore password in the resource
+	keystorePasswordKey = "keystore_password"
+	// keystoreIterations is the iteration count of the key derivation in a pkcs12 keystore
+	keystoreIterations = 10000
+)
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidJavaTrustedKeyUsage  = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage  = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidJavaKeyProtector     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+	errNoKeystorePassword   = errors.New("no keystore password, use the keystore_password, keystore_password_env or keystore_password_secret option")
+	javaKeystoreMagic       = uint32(0xfeedfeed)
+	javaKeystoreIntegrity   = []byte("Mighty Aphrodite")
+	javaKeystoreCertificate = "X.509"
+)
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// keystorePassword resolves the password of the keystore of the resource, from the option, a vault secret or the
+// environment, in that order
+func (r VaultService) keystorePassword(rn *watchedResource, client *api.Client) (string, error) {
+	if rn.resource.keystorePassword != "" {
+		return rn.resource.keystorePassword, nil
+	}
+	if rn.resource.keystorePasswordSecret != "" {
+		// step: the key of the password in the secret is given after a '#', i.e. secret/app#password
+		secretPath, key := rn.resource.keystorePasswordSecret, "password"
+		if i := strings.LastIndex(secretPath, "#"); i > 0 {
+			secretPath, key = secretPath[:i], secretPath[i+1:]
+		}
+		mount, err := rn.kvMountFor(client, secretPath)
+		if err != nil {
+			return "", err
+		}
+		secret, _, err := readKV(client, mount, secretPath, 0)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the keystore password: %s, error: %s", secretPath, err)
+		}
+		if secret == nil {
+			return "", fmt.Errorf("the keystore password secret: %s does not exist", secretPath)
+		}
+		password, found := secret.Data[key].(string)
+		if !found || password == "" {
+			return "", fmt.Errorf("the keystore password secret: %s has no key: %s", secretPath, key)
+		}
+		return password, nil
+	}
+	name := defaultKeystorePasswordEnv
+	if rn.resource.keystorePasswordEnv != "" {
+		name = rn.resource.keystorePasswordEnv
+	}
+	if password := getEnv(name, ""); password != "" {
+		return password, nil
+	}
+
+	return "", errNoKeystorePassword
+}
+
+// encodePKCS12Keystore encodes the private key and certificate chain as a pkcs12 keystore; the key is encrypted with
+// pbes2 (aes-256-cbc, pbkdf2 with hmac-sha256) and the keystore has a hmac-sha256 mac, as read by java 11 or later
+func encodePKCS12Keystore(alias string, key interface{}, chain []*x509.Certificate, password string) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptPBES2(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	localKeyID := sha1.Sum(chain[0].Raw)
+	attributes := []pkcs12Attribute{friendlyNameAttribute(alias), localKeyIDAttribute(localKeyID[:])}
+
+	keyBag, err := asn1.Marshal(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	keys := []pkcs12SafeBag{{ID: oidShroudedKeyBag, Value: explicitTag(keyBag), Attributes: attributes}}
+
+	var certificates []pkcs12SafeBag
+	for i, certificate := range chain {
+		bag, err := newPKCS12CertBag(certificate)
+		if err != nil {
+			return nil, err
+		}
+		// step: the chain is matched to the key by the issuer, only the certificate of the key is named
+		if i == 0 {
+			bag.Attributes = attributes
+		}
+		certificates = append(certificates, bag)
+	}
+
+	return encodePKCS12(password, certificates, keys)
+}
+
+// encodePKCS12Truststore encodes the certificates as a pkcs12 truststore, marking each of them as trusted for java
+func encodePKCS12Truststore(alias string, trusted []*x509.Certificate, password string) ([]byte, error) {
+	trustedUsage, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []pkcs12SafeBag
+	for i, certificate := range trusted {
+		bag, err := newPKCS12CertBag(certificate)
+		if err != nil {
+			return nil, err
+		}
+		bag.Attributes = []pkcs12Attribute{
+			friendlyNameAttribute(trustedAlias(alias, i)),
+			{ID: oidJavaTrustedKeyUsage, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: trustedUsage}},
+		}
+		certificates = append(certificates, bag)
+	}
+
+	return encodePKCS12(password, certificates, nil)
+}
+
+// encodePKCS12 encodes the safe bags in a pfx, with the certificates and keys in a safe each
+func encodePKCS12(password string, safes ...[]pkcs12SafeBag) ([]byte, error) {
+	var contents []pkcs12ContentInfo
+	for _, bags := range safes {
+		if len(bags) == 0 {
+			continue
+		}
+		content, err := newPKCS12Data(bags)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+	authenticatedSafe, err := asn1.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := newPKCS12Data(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: the mac key is derived as described in rfc 7292, appendix b
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := pkcs12KDF(sha256.New, 32, 64, salt, bmpString(password), keystoreIterations, 3, 32)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(authenticatedSafe)
+
+	return asn1.Marshal(pkcs12PFX{
+		Version:  3,
+		AuthSafe: authSafe,
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: keystoreIterations,
+		},
+	})
+}
+
+// newPKCS12Data wraps the content, encoded unless already der, in a pkcs7 data content info
+func newPKCS12Data(content interface{}) (pkcs12ContentInfo, error) {
+	der, ok := content.([]byte)
+	if !ok {
+		encoded, err := asn1.Marshal(content)
+		if err != nil {
+			return pkcs12ContentInfo{}, err
+		}
+		der = encoded
+	}
+	data, err := asn1.Marshal(der)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+
+	return pkcs12ContentInfo{ContentType: oidData, Content: explicitTag(data)}, nil
+}
+
+// newPKCS12CertBag creates the safe bag of a certificate
+func newPKCS12CertBag(certificate *x509.Certificate) (pkcs12SafeBag, error) {
+	bag, err := asn1.Marshal(pkcs12CertBag{ID: oidX509Certificate, Data: certificate.Raw})
+	if err != nil {
+		return pkcs12SafeBag{}, err
+	}
+
+	return pkcs12SafeBag{ID: oidCertBag, Value: explicitTag(bag)}, nil
+}
+
+// encryptPBES2 encrypts the private key with aes-256-cbc, the key derived from the password with pbkdf2
+func encryptPBES2(pkcs8 []byte, password string) (encryptedPrivateKeyInfo, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, keystoreIterations, 32)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	padding := aes.BlockSize - len(pkcs8)%aes.BlockSize
+	encrypted := append(append([]byte{}, pkcs8...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: keystoreIterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	encodedIV, err := asn1.Marshal(iv)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: encodedIV}},
+	})
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+
+	return encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	}, nil
+}
+
+// pkcs12KDF derives a key from the password as described in rfc 7292, appendix b.2; u is the size of the hash and v
+// its block size, the id is 1 for an encryption key, 2 for an iv and 3 for a mac key
+func pkcs12KDF(h func() hash.Hash, u, v int, salt, password []byte, iterations int, id byte, size int) []byte {
+	fill := func(x []byte) []byte {
+		if len(x) == 0 {
+			return nil
+		}
+		filled := make([]byte, v*((len(x)+v-1)/v))
+		for i := range filled {
+			filled[i] = x[i%len(x)]
+		}
+		return filled
+	}
+	diversifier := bytes.Repeat([]byte{id}, v)
+	input := append(fill(salt), fill(password)...)
+
+	var derived []byte
+	for len(derived) < size {
+		digest := h()
+		digest.Write(diversifier)
+		digest.Write(input)
+		a := digest.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			digest.Reset()
+			digest.Write(a)
+			a = digest.Sum(nil)
+		}
+		derived = append(derived, a...)
+
+		// step: each block of the input is incremented by the derived block plus one
+		b := fill(a)
+		for j := 0; j < len(input); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(input[j+k]) + int(b[k]) + carry
+				input[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+
+	return derived[:size]
+}
+
+// encodeJavaKeystore encodes the private key and certificate chain as a java keystore (jks)
+func encodeJavaKeystore(alias string, key interface{}, chain []*x509.Certificate, password string) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	protected, err := protectJavaKey(pkcs8, salt, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalJavaKeystore(alias, time.Now(), protected, chain, password), nil
+}
+
+// marshalJavaKeystore encodes a java keystore with a single private key entry, created at the time given
+func marshalJavaKeystore(alias string, created time.Time, protected []byte, chain []*x509.Certificate, password string) []byte {
+	var buf bytes.Buffer
+	writeJavaKeystoreHeader(&buf, 1)
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	writeJavaUTF(&buf, strings.ToLower(alias))
+	binary.Write(&buf, binary.BigEndian, created.UnixMilli())
+	binary.Write(&buf, binary.BigEndian, uint32(len(protected)))
+	buf.Write(protected)
+	binary.Write(&buf, binary.BigEndian, uint32(len(chain)))
+	for _, certificate := range chain {
+		writeJavaCertificate(&buf, certificate)
+	}
+
+	return signJavaKeystore(buf.Bytes(), password)
+}
+
+// encodeJavaTruststore encodes the certificates as trusted certificate entries of a java keystore (jks)
+func encodeJavaTruststore(alias string, trusted []*x509.Certificate, password string) ([]byte, error) {
+	return marshalJavaTruststore(alias, time.Now(), trusted, password), nil
+}
+
+// marshalJavaTruststore encodes the trusted certificate entries of a java keystore, created at the time given
+func marshalJavaTruststore(alias string, created time.Time, trusted []*x509.Certificate, password string) []byte {
+	var buf bytes.Buffer
+	writeJavaKeystoreHeader(&buf, len(trusted))
+	for i, certificate := range trusted {
+		binary.Write(&buf, binary.BigEndian, uint32(2))
+		writeJavaUTF(&buf, strings.ToLower(trustedAlias(alias, i)))
+		binary.Write(&buf, binary.BigEndian, created.UnixMilli())
+		writeJavaCertificate(&buf, certificate)
+	}
+
+	return signJavaKeystore(buf.Bytes(), password)
+}
+
+// protectJavaKey encrypts the private key with the proprietary key protector of the jks keystore
+func protectJavaKey(pkcs8, salt []byte, password string) ([]byte, error) {
+	passwd := utf16BigEndian(password)
+	// step: the key stream is sha1(password || previous digest), starting from the salt
+	protected := append([]byte{}, salt...)
+	digest := salt
+	for i := 0; i < len(pkcs8); i += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, passwd...), digest...))
+		digest = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(pkcs8); j++ {
+			protected = append(protected, pkcs8[i+j]^digest[j])
+		}
+	}
+	check := sha1.Sum(append(append([]byte{}, passwd...), pkcs8...))
+	protected = append(protected, check[:]...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJavaKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+}
+
+// signJavaKeystore appends the integrity check of the keystore, a sha1 of the password, a fixed phrase and the content
+func signJavaKeystore(content []byte, password string) []byte {
+	digest := sha1.New()
+	digest.Write(utf16BigEndian(password))
+	digest.Write(javaKeystoreIntegrity)
+	digest.Write(content)
+
+	return digest.Sum(content)
+}
+
+func writeJavaKeystoreHeader(buf *bytes.Buffer, entries int) {
+	binary.Write(buf, binary.BigEndian, javaKeystoreMagic)
+	binary.Write(buf, binary.BigEndian, uint32(2))
+	binary.Write(buf, binary.BigEndian, uint32(entries))
+}
+
+func writeJavaCertificate(buf *bytes.Buffer, certificate *x509.Certificate) {
+	writeJavaUTF(buf, javaKeystoreCertificate)
+	binary.Write(buf, binary.BigEndian, uint32(len(certificate.Raw)))
+	buf.Write(certificate.Raw)
+}
+
+// writeJavaUTF writes a string as read by java's DataInput.readUTF, which is utf-8 for anything but a nul
+func writeJavaUTF(buf *bytes.Buffer, value string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// parsePrivateKey parses a pem private key in the pkcs1, sec1 or pkcs8 encodings vault may return
+func parsePrivateKey(content []byte) (interface{}, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode the private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// trustedAlias is the alias of a trusted certificate, the first being the alias itself
+func trustedAlias(alias string, index int) string {
+	if index == 0 {
+		return alias
+	}
+
+	return fmt.Sprintf("%s-%d", alias, index)
+}
+
+func friendlyNameAttribute(name string) pkcs12Attribute {
+	value, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: utf16BigEndian(name)})
+	return pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value}}
+}
+
+func localKeyIDAttribute(id []byte) pkcs12Attribute {
+	value, _ := asn1.Marshal(id)
+	return pkcs12Attribute{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value}}
+}
+
+// explicitTag wraps the der in an explicit [0] tag
+func explicitTag(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// bmpString encodes the password as a nul terminated utf-16 string, as the pkcs12 key derivation expects
+func bmpString(value string) []byte {
+	return append(utf16BigEndian(value), 0, 0)
+}
+
+func utf16BigEndian(value string) []byte {
+	var encoded []byte
+	for _, x := range utf16.Encode([]rune(value)) {
+		encoded = append(encoded, byte(x>>8), byte(x))
+	}
+
+	return encoded
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestKeystoreData creates the data of a pki resource, a certificate and key issued by the ca
+func newTestKeystoreData(t *testing.T) (map[string]interface{}, *ecdsa.PrivateKey) {
+	ca, caKey := newTestCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "app.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	issuingCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+
+	return map[string]interface{}{
+		"certificate":       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"private_key":       string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey})),
+		"issuing_ca":        issuingCA,
+		"ca_chain":          []interface{}{issuingCA},
+		keystorePasswordKey: "changeit",
+	}, key
+}
+
+// readTestPKCS12 verifies the mac of the pkcs12 keystore and returns the certificates and decrypted private key
+func readTestPKCS12(t *testing.T, content []byte, password string) ([]pkcs12SafeBag, interface{}) {
+	var pfx pkcs12PFX
+	_, err := asn1.Unmarshal(content, &pfx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pfx.Version)
+	var authenticatedSafe []byte
+	_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe)
+	require.NoError(t, err)
+
+	key := pkcs12KDF(sha256.New, 32, 64, pfx.MacData.MacSalt, bmpString(password), pfx.MacData.Iterations, 3, 32)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(authenticatedSafe)
+	require.True(t, hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest), "the mac of the keystore is invalid")
+
+	var contents []pkcs12ContentInfo
+	_, err = asn1.Unmarshal(authenticatedSafe, &contents)
+	require.NoError(t, err)
+	var certificates []pkcs12SafeBag
+	var privateKey interface{}
+	for _, x := range contents {
+		var data []byte
+		_, err = asn1.Unmarshal(x.Content.Bytes, &data)
+		require.NoError(t, err)
+		var bags []pkcs12SafeBag
+		_, err = asn1.Unmarshal(data, &bags)
+		require.NoError(t, err)
+		for _, bag := range bags {
+			if bag.ID.Equal(oidCertBag) {
+				certificates = append(certificates, bag)
+				continue
+			}
+			require.True(t, bag.ID.Equal(oidShroudedKeyBag))
+			var encrypted encryptedPrivateKeyInfo
+			_, err = asn1.Unmarshal(bag.Value.Bytes, &encrypted)
+			require.NoError(t, err)
+			var params pbes2Params
+			_, err = asn1.Unmarshal(encrypted.Algorithm.Parameters.FullBytes, &params)
+			require.NoError(t, err)
+			var kdf pbkdf2Params
+			_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+			require.NoError(t, err)
+			var iv []byte
+			_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+			require.NoError(t, err)
+			derived, err := pbkdf2.Key(sha256.New, password, kdf.Salt, kdf.Iterations, 32)
+			require.NoError(t, err)
+			block, err := aes.NewCipher(derived)
+			require.NoError(t, err)
+			decrypted := make([]byte, len(encrypted.EncryptedData))
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted.EncryptedData)
+			padding := int(decrypted[len(decrypted)-1])
+			privateKey, err = x509.ParsePKCS8PrivateKey(decrypted[:len(decrypted)-padding])
+			require.NoError(t, err)
+		}
+	}
+
+	return certificates, privateKey
+}
+
+// readTestJavaKeystore verifies the integrity of the java keystore and returns the aliases, certificates and
+// decrypted private key of its entries
+func readTestJavaKeystore(t *testing.T, content []byte, password string) ([]string, [][]byte, interface{}) {
+	passwd := utf16BigEndian(password)
+	digest := sha1.New()
+	digest.Write(passwd)
+	digest.Write([]byte("Mighty Aphrodite"))
+	digest.Write(content[:len(content)-sha1.Size])
+	require.Equal(t, digest.Sum(nil), content[len(content)-sha1.Size:], "the integrity check of the keystore is invalid")
+
+	r := bytes.NewReader(content[:len(content)-sha1.Size])
+	read := func(size int) []byte {
+		x := make([]byte, size)
+		_, err := io.ReadFull(r, x)
+		require.NoError(t, err)
+		return x
+	}
+	readUint32 := func() int { return int(binary.BigEndian.Uint32(read(4))) }
+	readUTF := func() string { return string(read(int(binary.BigEndian.Uint16(read(2))))) }
+	readCertificate := func() []byte {
+		assert.Equal(t, "X.509", readUTF())
+		return read(readUint32())
+	}
+
+	require.Equal(t, 0xfeedfeed, readUint32())
+	require.Equal(t, 2, readUint32())
+	var aliases []string
+	var certificates [][]byte
+	var privateKey interface{}
+	for entries := readUint32(); entries > 0; entries-- {
+		tag := readUint32()
+		aliases = append(aliases, readUTF())
+		read(8)
+		if tag == 2 {
+			certificates = append(certificates, readCertificate())
+			continue
+		}
+		require.Equal(t, 1, tag)
+		_, plain := readTestJavaKeyProtector(t, read(readUint32()), password)
+		var err error
+		privateKey, err = x509.ParsePKCS8PrivateKey(plain)
+		require.NoError(t, err)
+		for chain := readUint32(); chain > 0; chain-- {
+			certificates = append(certificates, readCertificate())
+		}
+	}
+	assert.Zero(t, r.Len())
+
+	return aliases, certificates, privateKey
+}
+
+// readTestJavaKeyProtector verifies and decrypts a private key protected by the jks key protector, returning the
+// salt and the pkcs8 encoded key
+func readTestJavaKeyProtector(t *testing.T, content []byte, password string) ([]byte, []byte) {
+	passwd := utf16BigEndian(password)
+	var encrypted encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(content, &encrypted)
+	require.NoError(t, err)
+	require.True(t, encrypted.Algorithm.Algorithm.Equal(oidJavaKeyProtector))
+	protected := encrypted.EncryptedData
+	salt, data, check := protected[:20], protected[20:len(protected)-20], protected[len(protected)-20:]
+	stream := salt
+	plain := make([]byte, len(data))
+	for i := range data {
+		if i%sha1.Size == 0 {
+			sum := sha1.Sum(append(append([]byte{}, passwd...), stream...))
+			stream = sum[:]
+		}
+		plain[i] = data[i] ^ stream[i%sha1.Size]
+	}
+	sum := sha1.Sum(append(append([]byte{}, passwd...), plain...))
+	require.Equal(t, check, sum[:])
+
+	return salt, plain
+}
+
+func TestWriteKeystoreFilePKCS12(t *testing.T) {
+	dir := t.TempDir()
+	data, key := newTestKeystoreData(t)
+	filename := filepath.Join(dir, "app")
+	require.NoError(t, writeKeystoreFile(filename, data, 0600, "pki", "pkcs12", "app"))
+
+	content, err := ioutil.ReadFile(filename + ".p12")
+	require.NoError(t, err)
+	certificates, privateKey := readTestPKCS12(t, content, "changeit")
+	assert.True(t, key.Equal(privateKey))
+	require.Len(t, certificates, 2)
+	assert.Len(t, certificates[0].Attributes, 2)
+	assert.Empty(t, certificates[1].Attributes)
+
+	content, err = ioutil.ReadFile(filename + "-truststore.p12")
+	require.NoError(t, err)
+	certificates, privateKey = readTestPKCS12(t, content, "changeit")
+	assert.Nil(t, privateKey)
+	require.Len(t, certificates, 1)
+	assert.True(t, certificates[0].Attributes[1].ID.Equal(oidJavaTrustedKeyUsage))
+
+	stat, err := os.Stat(filename + ".p12")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2, "the temporary files should have been renamed")
+}
+
+func TestWriteKeystoreFileJKS(t *testing.T) {
+	dir := t.TempDir()
+	data, key := newTestKeystoreData(t)
+	// step: the content of a certificate resource is not a ca bundle, so isn't trusted
+	data["content"] = newTestCertificatePEM(t, "unrelated", time.Now().Add(time.Hour))
+	filename := filepath.Join(dir, "app")
+	require.NoError(t, writeKeystoreFile(filename, data, 0600, "pki", "jks", ""))
+
+	content, err := ioutil.ReadFile(filename + ".jks")
+	require.NoError(t, err)
+	aliases, certificates, privateKey := readTestJavaKeystore(t, content, "changeit")
+	assert.Equal(t, []string{defaultKeystoreAlias}, aliases)
+	assert.True(t, key.Equal(privateKey))
+	assert.Len(t, certificates, 2)
+
+	content, err = ioutil.ReadFile(filename + "-truststore.jks")
+	require.NoError(t, err)
+	aliases, certificates, privateKey = readTestJavaKeystore(t, content, "changeit")
+	assert.Equal(t, []string{defaultKeystoreAlias}, aliases)
+	assert.Nil(t, privateKey)
+	assert.Len(t, certificates, 1)
+
+	// step: a keystore can't be written without a password
+	delete(data, keystorePasswordKey)
+	assert.Equal(t, errNoKeystorePassword, writeKeystoreFile(filename, data, 0600, "pki", "jks", ""))
+}
+
+// TestEncodeJavaKeystoreKeytool checks the encoding against a keystore and truststore generated by keytool, taken from
+// the gocql test data with the password cassandra; given the creation time and salt of the entry the encoding must be
+// byte for byte the same
+func TestEncodeJavaKeystoreKeytool(t *testing.T) {
+	// entryOffset is the offset of the creation time of the first entry, after the header, tag and alias
+	entryOffset := func(alias string) int { return 12 + 4 + 2 + len(alias) }
+	parseCertificates := func(content [][]byte) []*x509.Certificate {
+		var certificates []*x509.Certificate
+		for _, x := range content {
+			certificate, err := x509.ParseCertificate(x)
+			require.NoError(t, err)
+			certificates = append(certificates, certificate)
+		}
+		return certificates
+	}
+
+	content, err := ioutil.ReadFile("tests/keytool_keystore.jks")
+	require.NoError(t, err)
+	aliases, certificates, privateKey := readTestJavaKeystore(t, content, "cassandra")
+	require.Len(t, aliases, 1)
+	offset := entryOffset(aliases[0])
+	created := time.UnixMilli(int64(binary.BigEndian.Uint64(content[offset:])))
+	size := int(binary.BigEndian.Uint32(content[offset+8:]))
+	entry := content[offset+12 : offset+12+size]
+
+	salt, pkcs8 := readTestJavaKeyProtector(t, entry, "cassandra")
+	encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	assert.Equal(t, pkcs8, encoded)
+	protected, err := protectJavaKey(encoded, salt, "cassandra")
+	require.NoError(t, err)
+	assert.Equal(t, entry, protected)
+	assert.Equal(t, content, marshalJavaKeystore(aliases[0], created, protected, parseCertificates(certificates), "cassandra"))
+
+	content, err = ioutil.ReadFile("tests/keytool_truststore.jks")
+	require.NoError(t, err)
+	aliases, certificates, privateKey = readTestJavaKeystore(t, content, "cassandra")
+	require.Len(t, aliases, 1)
+	assert.Nil(t, privateKey)
+	created = time.UnixMilli(int64(binary.BigEndian.Uint64(content[entryOffset(aliases[0]):])))
+	assert.Equal(t, content, marshalJavaTruststore(aliases[0], created, parseCertificates(certificates), "cassandra"))
+}
+
+func TestWriteKeystoreFileCABundle(t *testing.T) {
+	dir := t.TempDir()
+	data := map[string]interface{}{
+		"content": newTestCertificatePEM(t, "root", time.Now().Add(time.Hour)) +
+			newTestCertificatePEM(t, "intermediate", time.Now().Add(time.Hour)),
+		keystorePasswordKey: "changeit",
+	}
+	filename := filepath.Join(dir, "ca")
+	require.NoError(t, writeKeystoreFile(filename, data, 0600, "pki-ca", "jks", "internal"))
+
+	_, err := os.Stat(filename + ".jks")
+	assert.True(t, os.IsNotExist(err))
+	content, err := ioutil.ReadFile(filename + "-truststore.jks")
+	require.NoError(t, err)
+	aliases, certificates, _ := readTestJavaKeystore(t, content, "changeit")
+	assert.Equal(t, []string{"internal", "internal-1"}, aliases)
+	assert.Len(t, certificates, 2)
+}
+
+func TestKeystorePassword(t *testing.T) {
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2})
+	mux.HandleFunc("/v1/secret/data/jvm", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"data": {"data": {"password": "from-vault", "store": "store-password"}}}`))
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+	os.Setenv(defaultKeystorePasswordEnv, "from-env")
+	os.Setenv("APP_KEYSTORE_PASSWORD", "from-app-env")
+	defer os.Unsetenv(defaultKeystorePasswordEnv)
+	defer os.Unsetenv("APP_KEYSTORE_PASSWORD")
+
+	for _, c := range []struct {
+		Resource string
+		Expected string
+	}{
+		{Resource: "pki:pki/issue/app:common_name=app,fmt=pkcs12,keystore_password=from-option", Expected: "from-option"},
+		{Resource: "pki:pki/issue/app:common_name=app,fmt=pkcs12,keystore_password_secret=secret/jvm", Expected: "from-vault"},
+		{Resource: "pki:pki/issue/app:common_name=app,fmt=jks,keystore_password_secret=secret/jvm#store", Expected: "store-password"},
+		{Resource: "pki:pki/issue/app:common_name=app,fmt=jks", Expected: "from-env"},
+		{Resource: "pki:pki/issue/app:common_name=app,fmt=jks,keystore_password_env=APP_KEYSTORE_PASSWORD", Expected: "from-app-env"},
+	} {
+		var items VaultResources
+		require.NoError(t, items.Set(c.Resource))
+		require.NoError(t, items.items[0].IsValid())
+		password, err := service.keystorePassword(&watchedResource{resource: items.items[0]}, service.client)
+		require.NoError(t, err, c.Resource)
+		assert.Equal(t, c.Expected, password, c.Resource)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// kvMount is the kv secret engine a path is mounted on
+type kvMount struct {
+	// the path of the mount, i.e. secret/
+	path string
+	// the version of the kv engine, 1 or 2
+	version int
+	// indicates the mount couldn't be looked up and the path is read as given
+	assumed bool
+}
+
+// detectKVMount looks up the mount of the path; a path which isn't on a kv version 2 mount is read as version 1
+func detectKVMount(client *api.Client, secretPath string) (*kvMount, error) {
+	mount := &kvMount{version: 1}
+
+	secret, err := client.Logical().Read(path.Join("sys/internal/ui/mounts", secretPath))
+	if err != nil {
+		// older versions of vault don't have the endpoint, and only have version 1
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return mount, nil
+		}
+		// the token may not be permitted to lookup the mount, which is a policy problem rather than an expired token,
+		// so the path is read as given; if the token has expired reading the secret fails as well
+		if isAuthError(err) {
+			glog.Warningf("unable to lookup the kv mount of the path: %s, reading it as given, error: %s", secretPath, err)
+			mount.assumed = true
+			return mount, nil
+		}
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return mount, nil
+	}
+	mount.path, _ = secret.Data["path"].(string)
+	if kind, _ := secret.Data["type"].(string); kind == "kv" {
+		if opts, ok := secret.Data["options"].(map[string]interface{}); ok && opts["version"] == "2" {
+			mount.version = 2
+		}
+	}
+	glog.V(4).Infof("the path: %s is on the kv mount: %s, version: %d", secretPath, mount.path, mount.version)
+
+	return mount, nil
+}
+
+// dataPath returns the logical path the secret is read from
+func (m *kvMount) dataPath(secretPath string) string {
+	return m.rewrite(secretPath, "data")
+}
+
+// metadataPath returns the logical path of the metadata of the secret
+func (m *kvMount) metadataPath(secretPath string) string {
+	return m.rewrite(secretPath, "metadata")
+}
+
+// rewrite places the prefix between the mount and the secret for version 2 mounts; a path already
+// spelled with the data prefix, i.e. secret/data/db, is accepted
+func (m *kvMount) rewrite(secretPath, prefix string) string {
+	if m.version < 2 || m.path == "" {
+		return secretPath
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(secretPath, "/"), m.path)
+	name = strings.TrimPrefix(name, "data/")
+
+	return path.Join(m.path, prefix, name)
+}
+
+// readSecret reads a secret resource from its kv mount, creating the secret if required; it also returns whether
+// the secret differs from the one last retrieved
+func (r VaultService) readSecret(rn *watchedResource, client *api.Client) (*api.Secret, bool, error) {
+	mount, err := rn.kvMountFor(client, rn.resource.path)
+	if err != nil {
+		return nil, false, err
+	}
+	// step: a kv version 2 secret is only read again when a new version has been written
+	if mount.version == 2 && rn.resource.version == 0 && rn.secret != nil && rn.metadata != nil {
+		current, err := currentKVVersion(client, mount, rn.resource.path)
+		if err != nil {
+			glog.V(4).Infof("unable to read the metadata of resource: %s, reading the secret, error: %s", rn.resource, err)
+		} else if current == fmt.Sprintf("%v", rn.metadata["version"]) {
+			glog.V(4).Infof("resource: %s is at the current version: %s", rn.resource, current)
+			return rn.secret, false, nil
+		}
+	}
+
+	secret, metadata, err := readKV(client, mount, rn.resource.path, rn.resource.version)
+	if err != nil {
+		return nil, false, err
+	}
+	// We must generate the secret if we have the create flag
+	if rn.resource.create && secret == nil {
+		// step: without the mount we can't tell if the secret should be written with check-and-set
+		if mount.assumed {
+			return nil, false, fmt.Errorf("unable to create the resource: %s, the kv mount couldn't be looked up, "+
+				"the token requires read on sys/internal/ui/mounts/%s", rn.resource, rn.resource.path)
+		}
+		if err := createKV(client, mount, rn.resource); err != nil {
+			return nil, false, err
+		}
+		// Populate the secret data as stored in Vault...
+		secret, metadata, err = readKV(client, mount, rn.resource.path, rn.resource.version)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if secret == nil {
+		return nil, false, nil
+	}
+	// step: when the metadata couldn't be read the version of the secret itself tells us if it has changed
+	if rn.secret != nil && rn.metadata != nil && metadata != nil &&
+		fmt.Sprintf("%v", metadata["version"]) == fmt.Sprintf("%v", rn.metadata["version"]) {
+		glog.V(4).Infof("resource: %s is at the current version: %v", rn.resource, metadata["version"])
+		return rn.secret, false, nil
+	}
+
+	// step: the metadata of a kv version 2 secret is added to the data on request
+	rn.metadata = metadata
+	if rn.resource.kvMetadata && metadata != nil {
+		if _, found := secret.Data["metadata"]; found {
+			glog.Warningf("resource: %s has a metadata field, the kv metadata will not be added", rn.resource)
+		} else {
+			secret.Data["metadata"] = metadata
+		}
+	}
+
+	return secret, true, nil
+}
+
+// kvMountFor returns the kv mount of the path, detecting it on first use; a mount which couldn't be looked up
+// is looked up again next time
+func (r *watchedResource) kvMountFor(client *api.Client, secretPath string) (*kvMount, error) {
+	if mount, found := r.kvMounts[secretPath]; found {
+		return mount, nil
+	}
+	mount, err := detectKVMount(client, secretPath)
+	if err != nil {
+		return nil, err
+	}
+	if mount.assumed {
+		return mount, nil
+	}
+	if r.kvMounts == nil {
+		r.kvMounts = make(map[string]*kvMount)
+	}
+	r.kvMounts[secretPath] = mount
+
+	return mount, nil
+}
+
+// createKV generates the fields of a secret which doesn't exist and writes it; on a version 2 mount the write is
+// made with check-and-set, so when several replicas start together only one wins and the others read its secret
+func createKV(client *api.Client, mount *kvMount, rn *VaultResource) error {
+	fields := rn.fields
+	if len(fields) == 0 {
+		fields = []string{"value"}
+	}
+	data := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		data[field] = newPassword(int(rn.size))
+	}
+	glog.V(3).Infof("Create param specified, creating resource: %s, fields: %v", rn.path, fields)
+
+	var err error
+	if mount.version < 2 {
+		_, err = client.Logical().Write(rn.path, data)
+	} else {
+		_, err = client.Logical().Write(mount.dataPath(rn.path), map[string]interface{}{
+			"data":    data,
+			"options": map[string]interface{}{"cas": 0},
+		})
+		if isCASError(err) {
+			glog.V(3).Infof("resource: %s was created by another writer, using their secret", rn.path)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	glog.V(3).Infof("Secret created: %s", rn.path)
+
+	return nil
+}
+
+// isCASError checks if the error is a kv version 2 write refused by check-and-set
+func isCASError(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, message := range respErr.Errors {
+		if strings.Contains(message, "check-and-set") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentKVVersion returns the current version of a kv version 2 secret from its metadata
+func currentKVVersion(client *api.Client, mount *kvMount, secretPath string) (string, error) {
+	secret, err := client.Logical().Read(mount.metadataPath(secretPath))
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data["current_version"] == nil {
+		return "", fmt.Errorf("no metadata found for the secret: %s", secretPath)
+	}
+
+	return fmt.Sprintf("%v", secret.Data["current_version"]), nil
+}
+
+// readKV reads a secret from the kv mount, at the version if given; the data of a version 2 secret is
+// returned in the secret and the metadata returned separately
+func readKV(client *api.Client, mount *kvMount, secretPath string, version int) (*api.Secret, map[string]interface{}, error) {
+	if mount.version < 2 {
+		if version > 0 {
+			return nil, nil, fmt.Errorf("the path: %s is not on a kv version 2 mount, versions are not supported", secretPath)
+		}
+		secret, err := client.Logical().Read(secretPath)
+		if err != nil || secret == nil || !mount.assumed {
+			return secret, nil, err
+		}
+		// step: a path spelled with the data prefix on a version 2 mount we couldn't look up returns the envelope
+		metadata, isMetadata := secret.Data["metadata"].(map[string]interface{})
+		data, isData := secret.Data["data"].(map[string]interface{})
+		if isMetadata && isData {
+			secret.Data = data
+			return secret, metadata, nil
+		}
+		return secret, nil, nil
+	}
+
+	params := make(map[string][]string)
+	if version > 0 {
+		params["version"] = []string{strconv.Itoa(version)}
+	}
+	secret, err := client.Logical().ReadWithData(mount.dataPath(secretPath), params)
+	if err != nil || secret == nil {
+		return nil, nil, err
+	}
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	data, _ := secret.Data["data"].(map[string]interface{})
+	// step: a deleted or destroyed version has no data
+	if data == nil {
+		return nil, metadata, nil
+	}
+	secret.Data = data
+
+	return secret, metadata, nil
+}
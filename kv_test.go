@@ -0,0 +1,286 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handleTestKVMounts serves the mount detection of a fake vault, with the kv version of each mount
+func handleTestKVMounts(mux *http.ServeMux, mounts map[string]int) {
+	mux.HandleFunc("/v1/sys/internal/ui/mounts/", func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, "/v1/sys/internal/ui/mounts/")
+		for mount, version := range mounts {
+			if strings.HasPrefix(path, mount) {
+				fmt.Fprintf(w, `{"data": {"path": "%s", "type": "kv", "options": {"version": "%d"}}}`, mount, version)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": []}`)
+	})
+}
+
+func TestKVMountRewrite(t *testing.T) {
+	mount := &kvMount{path: "secret/", version: 2}
+	assert.Equal(t, "secret/data/db/prod", mount.dataPath("secret/db/prod"))
+	assert.Equal(t, "secret/data/db/prod", mount.dataPath("secret/data/db/prod"))
+	assert.Equal(t, "secret/metadata/db/prod", mount.metadataPath("secret/db/prod"))
+
+	mount = &kvMount{path: "secret/", version: 1}
+	assert.Equal(t, "secret/db/prod", mount.dataPath("secret/db/prod"))
+}
+
+func TestReadSecretKV(t *testing.T) {
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"kv/": 2, "legacy/": 1})
+	mux.HandleFunc("/v1/kv/data/db", func(w http.ResponseWriter, req *http.Request) {
+		version := req.URL.Query().Get("version")
+		if version == "" {
+			version = "3"
+		}
+		fmt.Fprintf(w, `{"data": {"data": {"password": "pass%s"}, "metadata": {"version": %s, "created_time": "2018-03-22T02:24:06.945319214Z"}}}`,
+			version, version)
+	})
+	mux.HandleFunc("/v1/legacy/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data": {"metadata": "a field", "data": "another field"}}`)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	for _, c := range []struct {
+		Resource string
+		Expected map[string]interface{}
+	}{
+		{Resource: "secret:kv/db", Expected: map[string]interface{}{"password": "pass3"}},
+		{Resource: "secret:kv/data/db:version=2", Expected: map[string]interface{}{"password": "pass2"}},
+		{Resource: "secret:legacy/db", Expected: map[string]interface{}{"metadata": "a field", "data": "another field"}},
+	} {
+		var items VaultResources
+		require.NoError(t, items.Set(c.Resource))
+		rn := &watchedResource{resource: items.items[0]}
+		require.NoError(t, service.get(rn), c.Resource)
+		assert.Equal(t, c.Expected, rn.secret.Data, c.Resource)
+	}
+
+	var items VaultResources
+	require.NoError(t, items.Set("secret:kv/db:metadata=true"))
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, "pass3", rn.secret.Data["password"])
+	assert.Equal(t, "3", fmt.Sprintf("%v", rn.metadata["version"]))
+	assert.Equal(t, rn.metadata, rn.secret.Data["metadata"])
+
+	require.NoError(t, items.Set("secret:legacy/db:version=2"))
+	assert.Error(t, service.get(&watchedResource{resource: items.items[1]}))
+}
+
+func TestReadSecretKVMountDenied(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/internal/ui/mounts/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/secret/data/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data": {"data": {"password": "pass"}, "metadata": {"version": 3}}}`)
+	})
+	mux.HandleFunc("/v1/legacy/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data": {"data": {"password": "pass"}}}`)
+	})
+	mux.HandleFunc("/v1/secret/data/missing", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": []}`)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	// step: a token which can't lookup the mount reads the path as given, rather than re-authenticating, and a
+	// version 2 response is still unwrapped
+	var items VaultResources
+	require.NoError(t, items.Set("secret:secret/data/db"))
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, map[string]interface{}{"password": "pass"}, rn.secret.Data)
+	assert.Equal(t, "3", fmt.Sprintf("%v", rn.metadata["version"]))
+	assert.Empty(t, rn.kvMounts)
+
+	require.NoError(t, items.Set("secret:legacy/db"))
+	rn = &watchedResource{resource: items.items[1]}
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{"password": "pass"}}, rn.secret.Data)
+
+	// step: a secret can't be created without knowing how to write it
+	require.NoError(t, items.Set("secret:secret/data/missing:create=true"))
+	rn = &watchedResource{resource: items.items[2]}
+	err := service.get(rn)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sys/internal/ui/mounts")
+}
+
+func TestReadSecretKVVersionPolling(t *testing.T) {
+	version, reads := 1, 0
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2})
+	mux.HandleFunc("/v1/secret/data/db", func(w http.ResponseWriter, req *http.Request) {
+		reads++
+		fmt.Fprintf(w, `{"data": {"data": {"password": "pass%d"}, "metadata": {"version": %d}}}`, version, version)
+	})
+	mux.HandleFunc("/v1/secret/metadata/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"data": {"current_version": %d}}`, version)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	var items VaultResources
+	require.NoError(t, items.Set("secret:secret/db"))
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, 1, reads)
+
+	// step: the secret is not read again until the version changes
+	require.NoError(t, service.get(rn))
+	assert.False(t, rn.changed)
+	assert.Equal(t, 1, reads)
+
+	version = 2
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, "pass2", rn.secret.Data["password"])
+
+	// step: a policy denying the metadata still only reports a change when the version changes
+	mux.HandleFunc("/v1/secret/metadata/denied", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/secret/data/denied", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"data": {"data": {"password": "pass%d"}, "metadata": {"version": %d}}}`, version, version)
+	})
+	require.NoError(t, items.Set("secret:secret/denied"))
+	rn = &watchedResource{resource: items.items[1]}
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	require.NoError(t, service.get(rn))
+	assert.False(t, rn.changed)
+
+	version = 3
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, "pass3", rn.secret.Data["password"])
+}
+
+func TestReadSecretKVCreate(t *testing.T) {
+	var stored map[string]interface{}
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2, "legacy/": 1})
+	mux.HandleFunc("/v1/secret/data/db", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors": []}`)
+				return
+			}
+			content, _ := json.Marshal(map[string]interface{}{"data": map[string]interface{}{"data": stored, "metadata": map[string]interface{}{"version": 1}}})
+			w.Write(content)
+		default:
+			var payload struct {
+				Data    map[string]interface{} `json:"data"`
+				Options map[string]interface{} `json:"options"`
+			}
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+			assert.Equal(t, float64(0), payload.Options["cas"])
+			if stored != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"errors": ["check-and-set parameter did not match the current version"]}`)
+				return
+			}
+			stored = payload.Data
+			fmt.Fprint(w, `{"data": {"version": 1}}`)
+		}
+	})
+	legacy := map[string]interface{}{}
+	mux.HandleFunc("/v1/legacy/db", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			if len(legacy) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors": []}`)
+				return
+			}
+			content, _ := json.Marshal(map[string]interface{}{"data": legacy})
+			w.Write(content)
+			return
+		}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&legacy))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	var items VaultResources
+	require.NoError(t, items.Set("secret:secret/db:create=true,fields=username|password,size=12,ttl=1h"))
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	// step: only the generated fields are written, not the options of the resource
+	assert.Len(t, stored, 2)
+	assert.Len(t, rn.secret.Data["username"], 12)
+	assert.Len(t, rn.secret.Data["password"], 12)
+
+	// step: a second replica losing the race reads the secret of the first
+	stored, winner := nil, map[string]interface{}{"username": "first", "password": "winner"}
+	mux.HandleFunc("/v1/secret/data/race", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && stored == nil {
+			stored = winner
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+			return
+		}
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": ["check-and-set parameter did not match the current version"]}`)
+			return
+		}
+		content, _ := json.Marshal(map[string]interface{}{"data": map[string]interface{}{"data": stored, "metadata": map[string]interface{}{"version": 1}}})
+		w.Write(content)
+	})
+	require.NoError(t, items.Set("secret:secret/race:create=true,fields=username|password"))
+	rn = &watchedResource{resource: items.items[1]}
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, winner, rn.secret.Data)
+
+	// step: a version 1 secret is written flat
+	require.NoError(t, items.Set("secret:legacy/db:create=true"))
+	rn = &watchedResource{resource: items.items[2]}
+	require.NoError(t, service.get(rn))
+	assert.Len(t, rn.secret.Data["value"], defaultSize)
+
+	assert.Error(t, items.Set("aws:aws/creds/app:fields=a|b"))
+}
+
+func TestIsCASError(t *testing.T) {
+	assert.False(t, isCASError(nil))
+	assert.False(t, isCASError(errors.New("check-and-set parameter did not match the current version")))
+	assert.False(t, isCASError(&api.ResponseError{StatusCode: 500, Errors: []string{"check-and-set"}}))
+	assert.False(t, isCASError(&api.ResponseError{StatusCode: 400, Errors: []string{"invalid request"}}))
+	assert.True(t, isCASError(&api.ResponseError{StatusCode: 400, Errors: []string{"check-and-set parameter did not match the current version"}}))
+}
@@ -48,17 +48,40 @@ func main() {
 		glog.Infof("running in one-shot mode")
 	}
 
+	// step: the token sink must hear of every token, including a renewal straight after the login
+	var tokenListeners []chan TokenEvent
+	tokenUpdates := make(chan TokenEvent, 10)
+	if options.tokenSink != "" {
+		tokenListeners = append(tokenListeners, tokenUpdates)
+	}
+
 	// step: create a client to vault
-	vault, err := NewVaultService(options.vaultURL)
+	vault, err := NewVaultService(options.vaultURL, tokenListeners...)
 	if err != nil {
 		showUsage("unable to create the vault client: %s", err)
 	}
+	// step: are we writing the token to a sink
+	if options.tokenSink != "" {
+		sink := newTokenSink(vault.client, &options)
+		if err := sink.Write(vault.tokens.Current()); err != nil {
+			glog.Errorf("failed to write the token sink: %s, error: %s", options.tokenSink, err)
+			if options.requestToken {
+				os.Exit(1)
+			}
+		}
+		if options.requestToken {
+			glog.Infof("written the vault token to: %s, exiting...", options.tokenSink)
+			os.Exit(0)
+		}
+		go sink.watch(tokenUpdates)
+	}
+
 	// step: create a channel to receive events upon and add our resources for renewal
 	updates := make(chan VaultEvent, 10)
 	vault.AddListener(updates)
 
 	// step: setup the termination signals
-	signalChannel := make(chan os.Signal)
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	// step: add each of the resources to the service processor
@@ -0,0 +1,346 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// signCertificate generates the private key locally and has vault sign a certificate signing request for it,
+// so the key never leaves the process; the key is returned with the certificate as pki/issue would
+func signCertificate(client *api.Client, rn *VaultResource, params map[string]interface{}) (*api.Secret, error) {
+	keyType, keyBits, err := pkiKeyOptions(rn.options)
+	if err != nil {
+		return nil, err
+	}
+	key, keyPEM, err := generatePrivateKey(keyType, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := newCertificateRequest(key, rn.options)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: the key options are ours, the rest are passed to vault
+	data := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		if k != "key_type" && k != "key_bits" {
+			data[k] = v
+		}
+	}
+	data["csr"] = csr
+	signPath := strings.Replace(rn.path, "/issue/", "/sign/", 1)
+	glog.V(3).Infof("requesting vault sign a certificate for resource: %s, key type: %s, bits: %d", rn, keyType, keyBits)
+
+	secret, err := client.Logical().Write(signPath, data)
+	if err != nil || secret == nil {
+		return secret, err
+	}
+	secret.Data["private_key"] = keyPEM
+	secret.Data["private_key_type"] = keyType
+
+	return secret, nil
+}
+
+// pkiKeyOptions returns the type and size of the private key to generate, an rsa 2048 bit key by default
+func pkiKeyOptions(opts map[string]string) (string, int, error) {
+	keyType := opts["key_type"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	var keyBits int
+	if value, found := opts["key_bits"]; found {
+		bits, err := strconv.Atoi(value)
+		if err != nil {
+			return "", 0, fmt.Errorf("the key_bits option: %s is invalid, should be an integer", value)
+		}
+		keyBits = bits
+	}
+
+	switch keyType {
+	case "rsa":
+		if keyBits == 0 {
+			keyBits = 2048
+		}
+		if keyBits != 2048 && keyBits != 3072 && keyBits != 4096 {
+			return "", 0, fmt.Errorf("unsupported rsa key bits: %d, should be 2048, 3072 or 4096", keyBits)
+		}
+	case "ec":
+		if keyBits == 0 {
+			keyBits = 256
+		}
+		if keyBits != 224 && keyBits != 256 && keyBits != 384 && keyBits != 521 {
+			return "", 0, fmt.Errorf("unsupported ec key bits: %d, should be 224, 256, 384 or 521", keyBits)
+		}
+	default:
+		return "", 0, fmt.Errorf("unsupported key type: %s, should be rsa or ec", keyType)
+	}
+
+	return keyType, keyBits, nil
+}
+
+// generatePrivateKey generates a private key, returning it in the pem encoding vault uses
+func generatePrivateKey(keyType string, keyBits int) (crypto.Signer, string, error) {
+	if keyType == "rsa" {
+		key, err := rsa.GenerateKey(rand.Reader, keyBits)
+		if err != nil {
+			return nil, "", err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+		return key, strings.TrimSpace(string(encoded)), nil
+	}
+
+	curves := map[int]elliptic.Curve{
+		224: elliptic.P224(),
+		256: elliptic.P256(),
+		384: elliptic.P384(),
+		521: elliptic.P521(),
+	}
+	key, err := ecdsa.GenerateKey(curves[keyBits], rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	return key, strings.TrimSpace(string(encoded)), nil
+}
+
+// newCertificateRequest builds a pem encoded certificate signing request from the common_name, alt_names and
+// ip_sans options
+func newCertificateRequest(key crypto.Signer, opts map[string]string) (string, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: opts["common_name"]},
+	}
+	template.DNSNames = splitOption(opts["alt_names"])
+	for _, value := range splitOption(opts["ip_sans"]) {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", fmt.Errorf("invalid ip address: %s in the ip_sans option", value)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// defaultCABundleRefresh is how often the ca chains of a ca bundle are read again
+const defaultCABundleRefresh = time.Hour
+
+// readCABundle reads the ca chains of the pki mounts of the resource and returns a single pem bundle of the unique
+// certificates which have not expired
+func readCABundle(client *api.Client, rn *VaultResource) (*api.Secret, error) {
+	var certificates []*x509.Certificate
+	seen := make(map[[sha256.Size]byte]bool)
+	for _, mount := range splitOption(rn.path) {
+		chain, err := readCAChain(client, strings.Trim(mount, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the ca chain of the mount: %s, error: %s", mount, err)
+		}
+		for _, certificate := range chain {
+			fingerprint := sha256.Sum256(certificate.Raw)
+			if seen[fingerprint] {
+				continue
+			}
+			seen[fingerprint] = true
+			if time.Now().After(certificate.NotAfter) {
+				glog.V(3).Infof("dropping the expired certificate: %s from the ca bundle", certificate.Subject)
+				continue
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found in the mounts: %s", rn.path)
+	}
+
+	var bundle bytes.Buffer
+	for _, certificate := range certificates {
+		if err := pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	secret := &api.Secret{
+		LeaseDuration: int(defaultCABundleRefresh.Seconds()),
+		Data: map[string]interface{}{
+			"content": bundle.String(),
+		},
+	}
+	if rn.update > 0 {
+		secret.LeaseDuration = int(rn.update.Seconds())
+	}
+
+	return secret, nil
+}
+
+// readCAChain reads the certificates of every issuer on the mount, falling back to the ca chain of the mount
+// for versions of vault with a single issuer
+func readCAChain(client *api.Client, mount string) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	issuers, err := client.Logical().List(mount + "/issuers")
+	if err != nil {
+		glog.V(4).Infof("unable to list the issuers of the mount: %s, reading the ca chain, error: %s", mount, err)
+	}
+	if err == nil && issuers != nil {
+		keys, _ := issuers.Data["keys"].([]interface{})
+		for _, key := range keys {
+			issuer, err := client.Logical().Read(fmt.Sprintf("%s/issuer/%s/json", mount, key))
+			if err != nil {
+				return nil, err
+			}
+			if issuer == nil {
+				continue
+			}
+			content := []string{fmt.Sprintf("%v", issuer.Data["certificate"])}
+			if list, ok := issuer.Data["ca_chain"].([]interface{}); ok {
+				for _, x := range list {
+					content = append(content, fmt.Sprintf("%v", x))
+				}
+			}
+			chain = append(chain, parsePEMCertificates([]byte(strings.Join(content, "\n")))...)
+		}
+		if len(chain) > 0 {
+			return chain, nil
+		}
+	}
+
+	// step: the ca chain of a root mount may be empty, in which case we take the ca
+	for _, endpoint := range []string{"ca_chain", "ca/pem"} {
+		resp, err := client.RawRequest(client.NewRequest("GET", fmt.Sprintf("/v1/%s/%s", mount, endpoint)))
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if chain = parsePEMCertificates(content); len(chain) > 0 {
+			return chain, nil
+		}
+	}
+
+	return chain, nil
+}
+
+// parsePEMCertificates parses the certificates in the pem content, skipping anything else
+func parsePEMCertificates(content []byte) []*x509.Certificate {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return certificates
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			glog.Warningf("skipping an invalid certificate in the ca chain, error: %s", err)
+			continue
+		}
+		certificates = append(certificates, certificate)
+	}
+}
+
+// revokeCertificate revokes a certificate by its serial number on the mount of the resource, or with its private key
+// when the revoke_with_key option is set, so the certificate ends up in the crl
+func revokeCertificate(client *api.Client, rn *VaultResource, serial string, privateKey interface{}) error {
+	mount := pkiMount(rn.path)
+	revokePath := path.Join(mount, "revoke")
+	data := map[string]interface{}{"serial_number": serial}
+	if rn.revokeWithKey {
+		key, _ := privateKey.(string)
+		if key == "" {
+			return fmt.Errorf("no private key held for the certificate: %s, unable to revoke with the key", serial)
+		}
+		revokePath = path.Join(mount, "revoke-with-key")
+		data["private_key"] = key
+	}
+	glog.V(3).Infof("attempting to revoke the certificate: %s, path: %s", serial, revokePath)
+
+	if _, err := client.Logical().Write(revokePath, data); err != nil {
+		return err
+	}
+	glog.V(3).Infof("successfully revoked the certificate: %s", serial)
+
+	return nil
+}
+
+// pkiMount returns the mount of the pki path, i.e. pki for pki/issue/app
+func pkiMount(pkiPath string) string {
+	for _, endpoint := range []string{"/issue/", "/sign/"} {
+		if i := strings.LastIndex(pkiPath, endpoint); i > 0 {
+			return pkiPath[:i]
+		}
+	}
+
+	return path.Dir(path.Dir(pkiPath))
+}
+
+// parseCertificate parses the pem encoded certificate of a pki resource
+func parseCertificate(data map[string]interface{}) (*x509.Certificate, error) {
+	content, _ := data["certificate"].(string)
+	block, _ := pem.Decode([]byte(content))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no pem encoded certificate found")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// splitOption splits a comma separated option into its values
+func splitOption(value string) []string {
+	var list []string
+	for _, x := range strings.Split(value, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
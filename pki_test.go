@@ -0,0 +1,288 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCA creates a self-signed certificate authority
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return ca, key
+}
+
+// handleTestPKISign serves pki/sign/<role> of a fake vault, signing the request with the ca
+func handleTestPKISign(t *testing.T, mux *http.ServeMux, path string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, validity time.Duration) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		assert.Empty(t, payload["key_type"])
+		block, _ := pem.Decode([]byte(payload["csr"]))
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		require.NoError(t, csr.CheckSignature())
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			IPAddresses:  csr.IPAddresses,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(validity),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, caKey)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+				"issuing_ca":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+				"serial_number": template.SerialNumber.Text(16),
+			},
+		})
+	})
+}
+
+func TestPKISignCertificate(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	mux := http.NewServeMux()
+	handleTestPKISign(t, mux, "/v1/pki/sign/app", ca, caKey, time.Hour)
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	for _, c := range []string{
+		"pki:pki/issue/app:common_name=app.example.com,alt_names=a.example.com|b.example.com,ip_sans=10.0.0.1,csr=true",
+		"pki:pki/sign/app:common_name=app.example.com,csr=true,key_type=ec,key_bits=384",
+	} {
+		var items VaultResources
+		require.NoError(t, items.Set(c))
+		require.NoError(t, items.items[0].IsValid())
+		rn := &watchedResource{resource: items.items[0]}
+		require.NoError(t, service.get(rn), c)
+
+		pair, err := tls.X509KeyPair([]byte(rn.secret.Data["certificate"].(string)), []byte(rn.secret.Data["private_key"].(string)))
+		require.NoError(t, err, c)
+		certificate, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		assert.Equal(t, "app.example.com", certificate.Subject.CommonName)
+		assert.Equal(t, items.items[0].options["key_type"] == "ec", rn.secret.Data["private_key_type"] == "ec")
+	}
+
+	var items VaultResources
+	require.NoError(t, items.Set("pki:pki/issue/app:common_name=app.example.com,alt_names=a.example.com|b.example.com,csr=true"))
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	block, _ := pem.Decode([]byte(rn.secret.Data["certificate"].(string)))
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, certificate.DNSNames)
+
+	require.NoError(t, items.Set("pki:pki/issue/app:common_name=app.example.com,csr=true,key_type=ec,key_bits=2048"))
+	assert.Error(t, items.items[1].IsValid())
+	assert.Error(t, items.Set("secret:secret/db:csr=true"))
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	now := time.Now()
+	certificate := &x509.Certificate{NotBefore: now, NotAfter: now.Add(3 * time.Hour)}
+
+	rn := watchedResource{resource: &VaultResource{resource: "pki"}}
+	assert.InDelta(t, float64(2*time.Hour), float64(rn.certificateRenewal(certificate)), float64(time.Second))
+	rn.resource.renewFraction = 0.5
+	assert.InDelta(t, float64(90*time.Minute), float64(rn.certificateRenewal(certificate)), float64(time.Second))
+
+	// step: a certificate past the renewal point is issued again straight away
+	certificate.NotBefore = now.Add(-3 * time.Hour)
+	assert.Equal(t, time.Second, rn.certificateRenewal(certificate))
+
+	_, err := parseCertificate(map[string]interface{}{"certificate": "not a certificate"})
+	assert.Error(t, err)
+
+	var items VaultResources
+	assert.NoError(t, items.Set("pki:pki/issue/app:common_name=app.example.com,renew_fraction=0.75"))
+	assert.Equal(t, 0.75, items.items[0].renewFraction)
+	_, found := items.items[0].options[optionRenewFraction]
+	assert.False(t, found)
+	assert.Error(t, items.Set("pki:pki/issue/app:common_name=app.example.com,renew_fraction=2"))
+	assert.Error(t, items.Set("secret:secret/db:renew_fraction=0.5"))
+}
+
+func TestPKIMount(t *testing.T) {
+	assert.Equal(t, "pki", pkiMount("pki/issue/app"))
+	assert.Equal(t, "pki/int", pkiMount("pki/int/sign/app"))
+	assert.Equal(t, "pki", pkiMount("pki/roles/app"))
+}
+
+func TestRevokeSupersededResources(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	lock := &sync.Mutex{}
+	leases, revoked := 0, []string{}
+	mux := http.NewServeMux()
+	handleTestPKISign(t, mux, "/v1/pki/sign/app", ca, caKey, time.Hour)
+	mux.HandleFunc("/v1/database/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		leases++
+		fmt.Fprintf(w, `{"lease_id": "database/creds/app/%d", "lease_duration": 3600, "data": {"username": "user"}}`, leases)
+	})
+	mux.HandleFunc("/v1/sys/leases/revoke", func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		lock.Lock()
+		defer lock.Unlock()
+		revoked = append(revoked, payload["lease_id"])
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/pki/revoke-with-key", func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		assert.NotEmpty(t, payload["private_key"])
+		lock.Lock()
+		defer lock.Unlock()
+		revoked = append(revoked, payload["serial_number"])
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	statsInterval := options.statsInterval
+	options.statsInterval = time.Hour
+	defer func() { options.statsInterval = statsInterval }()
+	service := &VaultService{
+		client:          newTestVaultClient(t, mux),
+		resourceChannel: make(chan *watchedResource, 20),
+	}
+	service.vaultServiceProcessor()
+
+	var items VaultResources
+	require.NoError(t, items.Set("database:database/creds/app:revoke=true,update=1s"))
+	require.NoError(t, items.Set("pki:pki/issue/app:common_name=app.example.com,csr=true,key_type=ec,revoke=true,revoke_with_key=true,update=1s"))
+	var serials []string
+	updates := make(chan VaultEvent, 10)
+	service.AddListener(updates)
+	for _, rn := range items.items {
+		service.Watch(rn)
+	}
+	for len(serials) < 2 {
+		select {
+		case evt := <-updates:
+			if serial, found := evt.Secret["serial_number"].(string); found {
+				serials = append(serials, serial)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the certificate to be issued again")
+		}
+	}
+
+	// step: the superseded lease and certificate are revoked, not the new ones
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return contains("database/creds/app/1", revoked) && contains(serials[0], revoked)
+	}, 5*time.Second, 50*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.False(t, contains(fmt.Sprintf("database/creds/app/%d", leases), revoked))
+}
+
+// newTestCertificatePEM creates a self signed ca certificate expiring at the time given
+func newTestCertificatePEM(t *testing.T, name string, expires time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             expires.Add(-24 * time.Hour),
+		NotAfter:              expires,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCABundle(t *testing.T) {
+	root := newTestCertificatePEM(t, "root", time.Now().Add(time.Hour))
+	rotated := newTestCertificatePEM(t, "rotated", time.Now().Add(time.Hour))
+	expired := newTestCertificatePEM(t, "expired", time.Now().Add(-time.Hour))
+	intermediate := newTestCertificatePEM(t, "intermediate", time.Now().Add(time.Hour))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pki/issuers", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.URL.Query().Get("list"))
+		fmt.Fprint(w, `{"data": {"keys": ["a", "b", "c"]}}`)
+	})
+	for id, certificate := range map[string]string{"a": root, "b": rotated, "c": expired} {
+		data, _ := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{"certificate": certificate, "ca_chain": []string{certificate}},
+		})
+		mux.HandleFunc("/v1/pki/issuer/"+id+"/json", func(w http.ResponseWriter, req *http.Request) {
+			w.Write(data)
+		})
+	}
+	// step: an older mount without issuers only has the ca chain
+	mux.HandleFunc("/v1/pki-int/ca_chain", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, intermediate+root)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	var items VaultResources
+	require.NoError(t, items.Set("pki-ca:pki,pki-int:update=10m"))
+	require.NoError(t, items.items[0].IsValid())
+	assert.Equal(t, "txt", items.items[0].format)
+	rn := &watchedResource{resource: items.items[0]}
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, 600, rn.secret.LeaseDuration)
+	assert.Equal(t, root+rotated+intermediate, rn.secret.Data["content"])
+
+	// step: the bundle is only written again when the certificates change
+	require.NoError(t, service.get(rn))
+	assert.False(t, rn.changed)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// defaultTemplateRefresh is how often a template is rendered again when none of its secrets has a lease
+const defaultTemplateRefresh = 5 * time.Minute
+
+// templateLeaseFraction is how far through its lease a secret of a template is read again
+const templateLeaseFraction = 2.0 / 3.0
+
+// templateDependency is a secret a template was rendered from
+type templateDependency struct {
+	// the secret read from vault
+	secret *api.Secret
+	// the kv metadata of the secret, if any
+	metadata map[string]interface{}
+	// the time the lease of the secret expires, zero if it has none
+	expires time.Time
+	// the time the secret is read again, zero to read it on every render
+	refresh time.Time
+}
+
+// renderTemplate renders the template of the resource, reading every secret it references from vault; the content
+// is returned as a secret with the shortest lease of the secrets it was rendered from
+func (r VaultService) renderTemplate(rn *watchedResource) (*api.Secret, error) {
+	client := r.clientFor(rn.resource)
+	dependencies := make(map[string]*templateDependency)
+
+	// step: read the secret once, no matter how many times it is referenced; a leased secret or a certificate from
+	// the last render is reused until it's due, as reading it again would issue another credential
+	read := func(path string, params []string) (*templateDependency, error) {
+		key := strings.Join(append([]string{path}, params...), " ")
+		if x, found := dependencies[key]; found {
+			return x, nil
+		}
+		if x, found := rn.dependencies[key]; found && time.Now().Before(x.refresh) {
+			dependencies[key] = x
+			return x, nil
+		}
+		secret, kvMetadata, err := readTemplateSecret(rn, client, path, params)
+		if err != nil {
+			return nil, err
+		}
+		dependencies[key] = rn.newTemplateDependency(secret, kvMetadata)
+
+		return dependencies[key], nil
+	}
+
+	funcs := template.FuncMap{
+		// secret reads a path from vault, or writes to it when given parameters, i.e. {{ secret "secret/db" }}
+		// or {{ secret "pki/issue/example" "common_name=example.com" }}
+		"secret": func(path string, params ...string) (map[string]interface{}, error) {
+			x, err := read(path, params)
+			if err != nil {
+				return nil, err
+			}
+			return x.secret.Data, nil
+		},
+		// metadata returns the metadata of a kv version 2 secret, i.e. {{ (metadata "secret/db").version }}
+		"metadata": func(path string) (map[string]interface{}, error) {
+			x, err := read(path, nil)
+			if err != nil {
+				return nil, err
+			}
+			return x.metadata, nil
+		},
+	}
+	name := filepath.Base(rn.resource.templateFile)
+	tpl, err := template.New(name).Funcs(funcs).ParseFiles(rn.resource.templateFile)
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	if err := tpl.Execute(&content, nil); err != nil {
+		// step: the secrets read before the failure are kept, so the next attempt reuses their leases rather than
+		// issuing more; a lease they replace is revoked along with the others once the template renders
+		if rn.dependencies == nil {
+			rn.dependencies = make(map[string]*templateDependency)
+		}
+		for key, x := range dependencies {
+			if previous, found := rn.dependencies[key]; found && previous != x && previous.secret.LeaseID != "" {
+				rn.superseded = append(rn.superseded, previous.secret.LeaseID)
+			}
+			rn.dependencies[key] = x
+		}
+		return nil, err
+	}
+
+	secret := &api.Secret{
+		Renewable: true,
+		Data: map[string]interface{}{
+			"content": content.String(),
+		},
+	}
+	for _, x := range dependencies {
+		if x.expires.IsZero() {
+			continue
+		}
+		lease := int(time.Until(x.expires).Round(time.Second).Seconds())
+		if lease < 1 {
+			lease = 1
+		}
+		if secret.LeaseDuration == 0 || lease < secret.LeaseDuration {
+			secret.LeaseDuration = lease
+		}
+		secret.Renewable = secret.Renewable && x.secret.Renewable
+	}
+	// step: without a lease we render again periodically to pick up changes to the secrets
+	if secret.LeaseDuration == 0 {
+		secret.LeaseDuration = int(defaultTemplateRefresh.Seconds())
+		secret.Renewable = false
+	}
+	glog.V(4).Infof("rendered the template: %s from %d secrets", rn.resource.templateFile, len(dependencies))
+
+	// step: the leases of the secrets read again, or no longer referenced, are handed to the processor to revoke
+	for key, x := range rn.dependencies {
+		if current, found := dependencies[key]; (!found || current != x) && x.secret.LeaseID != "" {
+			rn.superseded = append(rn.superseded, x.secret.LeaseID)
+		}
+	}
+	rn.dependencies = dependencies
+
+	return secret, nil
+}
+
+// newTemplateDependency creates a dependency of the template, scheduling when the secret is read again
+func (r *watchedResource) newTemplateDependency(secret *api.Secret, metadata map[string]interface{}) *templateDependency {
+	x := &templateDependency{secret: secret, metadata: metadata}
+	r.scheduleTemplateDependency(x)
+
+	return x
+}
+
+// scheduleTemplateDependency works out when the lease of the secret expires and when it is read again; a certificate
+// is issued again as a pki resource would be, whether it has a lease or not
+func (r *watchedResource) scheduleTemplateDependency(x *templateDependency) {
+	x.expires, x.refresh = time.Time{}, time.Time{}
+	if x.secret.LeaseID != "" && x.secret.LeaseDuration > 0 {
+		lease := time.Duration(x.secret.LeaseDuration) * time.Second
+		x.expires = time.Now().Add(lease)
+		x.refresh = time.Now().Add(time.Duration(float64(lease) * templateLeaseFraction))
+	}
+	if _, found := x.secret.Data["certificate"]; found {
+		if certificate, err := parseCertificate(x.secret.Data); err == nil {
+			if renewal := time.Now().Add(r.certificateRenewal(certificate)); x.refresh.IsZero() || renewal.Before(x.refresh) {
+				x.refresh = renewal
+			}
+		}
+	}
+}
+
+// renewTemplate renews the leases of the secrets the template was rendered from
+func (r VaultService) renewTemplate(rn *watchedResource) error {
+	client := r.clientFor(rn.resource)
+	lease := 0
+	for key, x := range rn.dependencies {
+		if x.expires.IsZero() {
+			continue
+		}
+		secret, err := client.Sys().Renew(x.secret.LeaseID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to renew the secret: %s, error: %s", key, err)
+		}
+		x.secret.LeaseDuration = secret.LeaseDuration
+		rn.scheduleTemplateDependency(x)
+		if lease == 0 || secret.LeaseDuration < lease {
+			lease = secret.LeaseDuration
+		}
+	}
+
+	// step: update the resource
+	rn.secret.LeaseDuration = lease
+	rn.lastUpdated = time.Now()
+	leaseDuration := time.Duration(lease) * time.Second
+	rn.leaseExpireTime = rn.lastUpdated.Add(leaseDuration)
+
+	glog.V(3).Infof("renewed the %d leases of resource: %s, leaseDuration: %s, expiration: %s",
+		len(rn.dependencies), rn.resource, leaseDuration, rn.leaseExpireTime)
+
+	return nil
+}
+
+// readTemplateSecret reads a secret referenced by a template, writing the parameters if any; the kv metadata is
+// returned for secrets on a kv version 2 mount
+func readTemplateSecret(rn *watchedResource, client *api.Client, path string, params []string) (*api.Secret, map[string]interface{}, error) {
+	var err error
+	var secret *api.Secret
+	var metadata map[string]interface{}
+	if len(params) > 0 {
+		data := make(map[string]interface{}, len(params))
+		for _, x := range params {
+			kp := strings.SplitN(x, "=", 2)
+			if len(kp) != 2 {
+				return nil, nil, fmt.Errorf("invalid parameter: %s for the secret: %s, must be KEY=VALUE", x, path)
+			}
+			data[kp[0]] = kp[1]
+		}
+		secret, err = client.Logical().Write(path, data)
+	} else {
+		var mount *kvMount
+		if mount, err = rn.kvMountFor(client, path); err != nil {
+			return nil, nil, err
+		}
+		secret, metadata, err = readKV(client, mount, path, 0)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret == nil {
+		return nil, nil, fmt.Errorf("the secret: %s does not exist", path)
+	}
+
+	return secret, metadata, nil
+}
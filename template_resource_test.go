@@ -0,0 +1,160 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateResource(t *testing.T) {
+	password := "pass1"
+	var renewed []string
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2})
+	mux.HandleFunc("/v1/secret/data/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"data": {"data": {"password": "%s"}, "metadata": {"version": 1}}}`, password)
+	})
+	mux.HandleFunc("/v1/database/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"lease_id": "database/creds/app/1", "lease_duration": 600, "renewable": true, "data": {"username": "user1"}}`)
+	})
+	mux.HandleFunc("/v1/pki/issue/app", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		fmt.Fprint(w, `{"lease_id": "pki/issue/app/1", "lease_duration": 300, "renewable": false, "data": {"serial_number": "01"}}`)
+	})
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, req *http.Request) {
+		renewed = append(renewed, req.URL.Path)
+		fmt.Fprint(w, `{"lease_id": "database/creds/app/1", "lease_duration": 400, "renewable": true}`)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	templateFile := filepath.Join(t.TempDir(), "db.tmpl")
+	content := `{{ with secret "secret/db" }}{{ .password }}{{ end }} ` +
+		`{{ (secret "database/creds/app").username }} {{ (secret "database/creds/app").username }}`
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(content), 0600))
+	rn := &watchedResource{resource: &VaultResource{resource: "tpl", path: "db", templateFile: templateFile}}
+
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, "pass1 user1 user1", rn.secret.Data["content"])
+	assert.Len(t, rn.dependencies, 2)
+	assert.Equal(t, 600, rn.secret.LeaseDuration)
+	assert.True(t, rn.secret.Renewable)
+
+	// step: the dependencies are renewed together
+	require.NoError(t, service.renew(rn))
+	assert.Len(t, renewed, 1)
+	assert.Equal(t, 400, rn.secret.LeaseDuration)
+
+	// step: the template is only written out when the content changes
+	require.NoError(t, service.get(rn))
+	assert.False(t, rn.changed)
+	password = "pass2"
+	require.NoError(t, service.get(rn))
+	assert.True(t, rn.changed)
+	assert.Equal(t, "pass2 user1 user1", rn.secret.Data["content"])
+
+	// step: a secret written with parameters takes the shortest lease
+	content = `{{ (secret "pki/issue/app" "common_name=example.com").serial_number }}`
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(content), 0600))
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, "01", rn.secret.Data["content"])
+	assert.Equal(t, 300, rn.secret.LeaseDuration)
+	assert.False(t, rn.secret.Renewable)
+
+	// step: the kv metadata is available to the template
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(`{{ (metadata "secret/db").version }}`), 0600))
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, "1", rn.secret.Data["content"])
+
+	// step: a missing secret fails the render
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(`{{ secret "secret/missing" }}`), 0600))
+	assert.Error(t, service.get(rn))
+}
+
+func TestTemplateResourceReusesLeases(t *testing.T) {
+	leases := 0
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2})
+	mux.HandleFunc("/v1/secret/data/db", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data": {"data": {"host": "db"}, "metadata": {"version": 1}}}`)
+	})
+	mux.HandleFunc("/v1/database/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		leases++
+		fmt.Fprintf(w, `{"lease_id": "database/creds/app/%d", "lease_duration": 600, "data": {"username": "user%d"}}`, leases, leases)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	templateFile := filepath.Join(t.TempDir(), "db.tmpl")
+	content := `{{ (secret "secret/db").host }} {{ (secret "database/creds/app").username }}`
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(content), 0600))
+	rn := &watchedResource{resource: &VaultResource{resource: "tpl", path: "db", templateFile: templateFile}}
+
+	// step: rendering again doesn't issue another credential while the lease is good
+	require.NoError(t, service.get(rn))
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, 1, leases)
+	assert.Equal(t, "db user1", rn.secret.Data["content"])
+	assert.Empty(t, rn.superseded)
+
+	// step: once the lease is due the credential is read again and the old lease is superseded
+	rn.dependencies["database/creds/app"].refresh = time.Now().Add(-time.Second)
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, 2, leases)
+	assert.True(t, rn.changed)
+	assert.Equal(t, "db user2", rn.secret.Data["content"])
+	assert.Equal(t, []string{"database/creds/app/1"}, rn.superseded)
+}
+
+func TestTemplateResourceKeepsLeasesOnFailure(t *testing.T) {
+	leases, failures := 0, 1
+	mux := http.NewServeMux()
+	handleTestKVMounts(mux, map[string]int{"secret/": 2})
+	mux.HandleFunc("/v1/database/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		leases++
+		fmt.Fprintf(w, `{"lease_id": "database/creds/app/%d", "lease_duration": 600, "data": {"username": "user%d"}}`, leases, leases)
+	})
+	mux.HandleFunc("/v1/database/creds/report", func(w http.ResponseWriter, req *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": ["role not ready"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"lease_id": "database/creds/report/1", "lease_duration": 600, "data": {"username": "report"}}`)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	templateFile := filepath.Join(t.TempDir(), "db.tmpl")
+	content := `{{ (secret "database/creds/app").username }} {{ (secret "database/creds/report").username }}`
+	require.NoError(t, ioutil.WriteFile(templateFile, []byte(content), 0600))
+	rn := &watchedResource{resource: &VaultResource{resource: "tpl", path: "db", templateFile: templateFile}}
+
+	// step: a failed render keeps the credential it issued, so the retry reuses it
+	require.Error(t, service.get(rn))
+	require.NoError(t, service.get(rn))
+	assert.Equal(t, 1, leases)
+	assert.Equal(t, "user1 report", rn.secret.Data["content"])
+	assert.Empty(t, rn.superseded)
+}
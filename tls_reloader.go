@@ -0,0 +1,109 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// keyPairReloader holds a client certificate and reloads it from disk when the files change
+type keyPairReloader struct {
+	// the path to the certificate
+	certFile string
+	// the path to the private key
+	keyFile string
+	// a lock protecting the certificate
+	lock *sync.Mutex
+	// the current certificate
+	certificate *tls.Certificate
+	// the modification time of the files when last loaded
+	modTime time.Time
+}
+
+// newKeyPairReloader loads the key pair and returns a reloader
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		lock:     &sync.Mutex{},
+	}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetClientCertificate returns the client certificate, reloading the key pair if the files have changed
+func (r *keyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTime, err := r.lastModified()
+	if err != nil {
+		glog.Errorf("unable to check the client certificate: %s, using the current one, error: %s", r.certFile, err)
+		return r.certificate, nil
+	}
+	if modTime.After(r.modTime) {
+		// a failure is likely caused by reading in between the files being written, we keep the current
+		// certificate and try again on the next handshake
+		if err := r.load(modTime); err != nil {
+			glog.Errorf("unable to reload the client certificate: %s, using the current one, error: %s", r.certFile, err)
+		}
+	}
+
+	return r.certificate, nil
+}
+
+// load reads in the key pair, the lock must be held by the caller
+func (r *keyPairReloader) load(modTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the client certificate: %s, key: %s, error: %s", r.certFile, r.keyFile, err)
+	}
+	glog.V(3).Infof("loaded the client certificate: %s, key: %s", r.certFile, r.keyFile)
+	r.certificate = &certificate
+	r.modTime = modTime
+
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and key
+func (r *keyPairReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return modTime, err
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
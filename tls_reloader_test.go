@@ -0,0 +1,90 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate generates a self-signed certificate, returning the certificate and key in pem
+func newTestCertificate(t *testing.T, commonName string, notBefore, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	writeKeyPair := func(commonName string, modTime time.Time) {
+		cert, key := newTestCertificate(t, commonName, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		require.NoError(t, os.WriteFile(certFile, cert, 0600))
+		require.NoError(t, os.WriteFile(keyFile, key, 0600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	commonName := func(r *keyPairReloader) string {
+		certificate, err := r.GetClientCertificate(nil)
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	writeKeyPair("first", time.Now().Add(-time.Minute))
+	reloader, err := newKeyPairReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(reloader))
+
+	writeKeyPair("second", time.Now())
+	assert.Equal(t, "second", commonName(reloader))
+
+	// step: a broken key pair should leave the current certificate in place
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	assert.Equal(t, "second", commonName(reloader))
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// minimumReauthInterval is the minimum time between two re-authentications with vault
+	minimumReauthInterval = 10 * time.Second
+	// tokenRenewalFraction is the fraction of the token lease after which we renew or login again
+	tokenRenewalFraction = 0.5
+	// maximumRefreshBackoff is the longest we wait between two failed attempts to refresh the token
+	maximumRefreshBackoff = 5 * time.Minute
+	// oneShotLoginAttempts is the number of attempts made to login when running once
+	oneShotLoginAttempts = 5
+)
+
+// TokenEventType is the type of change made to the vault token
+type TokenEventType int
+
+const (
+	// TokenEventLogin indicates a new token was issued by the authentication plugin
+	TokenEventLogin TokenEventType = iota
+	// TokenEventRenewal indicates the current token was renewed
+	TokenEventRenewal TokenEventType = iota
+)
+
+// TokenEvent is the definition which captures a change to the vault token
+type TokenEvent struct {
+	// the authentication response of the token
+	Auth *api.SecretAuth
+	// the time the lease on the token expires, zero if it never does
+	ExpireTime time.Time
+	// type of this event (login or renewal)
+	Type TokenEventType
+}
+
+// tokenManager is responsible for the lifecycle of the vault token; it renews renewable tokens
+// and logs in again before the token expires or when it can no longer be extended
+type tokenManager struct {
+	// the vault client
+	client *api.Client
+	// the configuration
+	opts *config
+	// a lock protecting the fields below
+	lock *sync.Mutex
+	// the authentication response of the current token
+	auth *api.SecretAuth
+	// the lease duration granted on login
+	loginLease time.Duration
+	// the time the current lease on the token expires
+	leaseExpireTime time.Time
+	// the last time we authenticated with vault
+	lastAuthenticated time.Time
+	// indicates the token has reached its max ttl and must be replaced
+	exhausted bool
+	// when set, the manager waits until this time before refreshing the token
+	holdUntil time.Time
+	// the listeners of token events
+	listeners []chan TokenEvent
+	// a channel used to wake up the manager when the token is changed
+	wakeup chan struct{}
+	// the backoff between failed attempts to login or refresh the token
+	backoff func(time.Duration) time.Duration
+	// the credentials unwrapped from the wrapping tokens, kept across logins as a wrapping token can only be used once
+	unwrapped *unwrapCache
+}
+
+// newTokenManager creates a new token manager for the client
+func newTokenManager(client *api.Client, opts *config) *tokenManager {
+	return &tokenManager{
+		client:    client,
+		opts:      opts,
+		lock:      &sync.Mutex{},
+		listeners: make([]chan TokenEvent, 0),
+		wakeup:    make(chan struct{}, 1),
+		backoff:   nextBackoff,
+		unwrapped: newUnwrapCache(),
+	}
+}
+
+// AddListener adds a listener to the token events
+func (r *tokenManager) AddListener(ch chan TokenEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.listeners = append(r.listeners, ch)
+}
+
+// Current returns the current token as an event
+func (r *tokenManager) Current() TokenEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return TokenEvent{Auth: r.auth, ExpireTime: r.leaseExpireTime, Type: TokenEventLogin}
+}
+
+// Login authenticates with vault using the configured plugin and sets the token on the client
+func (r *tokenManager) Login() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.login()
+}
+
+// LoginWithRetry performs the initial login, retrying a failed login with an exponential backoff rather than giving
+// up; zero attempts retries until the login succeeds. A failure which retrying won't fix is returned straight away
+func (r *tokenManager) LoginWithRetry(attempts int) error {
+	var backoff time.Duration
+	for attempt := 1; ; attempt++ {
+		err := r.Login()
+		if err == nil {
+			return nil
+		}
+		if isPermanentError(err) || (attempts > 0 && attempt >= attempts) {
+			return err
+		}
+		backoff = r.backoff(backoff)
+		glog.Errorf("failed to login to vault, retrying in %s, error: %s", backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// Reauthenticate logs in again, unless we have just done so or the token is still valid; it's called when vault
+// denies a request, which may be the token no longer being valid or simply a policy denying the path
+func (r *tokenManager) Reauthenticate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// step: a number of resources can fail together, we only need the one login
+	if time.Since(r.lastAuthenticated) < minimumReauthInterval {
+		glog.V(4).Infof("skipping re-authentication, last authenticated at: %s", r.lastAuthenticated)
+		return nil
+	}
+	// step: a token which is still valid is only denied the path, another token wouldn't be any different
+	if r.tokenValid() {
+		glog.V(3).Infof("the vault token is still valid, skipping re-authentication")
+		return nil
+	}
+	glog.Infof("the vault token is no longer valid, re-authenticating with method: %s", r.opts.vaultAuthOptions.Method)
+
+	return r.login()
+}
+
+// tokenValid checks if vault still accepts the current token; only a denied lookup proves it isn't, and a token which
+// isn't permitted to lookup itself must still be able to check its own capabilities
+func (r *tokenManager) tokenValid() bool {
+	if r.client.Token() == "" {
+		return false
+	}
+	_, err := r.client.Auth().Token().LookupSelf()
+	if !isAuthError(err) {
+		return true
+	}
+	_, err = r.client.Sys().CapabilitiesSelf("auth/token/lookup-self")
+
+	return !isAuthError(err)
+}
+
+// Reload replaces the authentication options, when given, and logs in again; it's called when the credentials
+// are changed on disk. The current token and options are kept if the login fails
+func (r *tokenManager) Reload(auth *vaultAuthOptions) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous := r.opts.vaultAuthOptions
+	if auth != nil {
+		r.opts.vaultAuthOptions = auth
+	}
+	glog.Infof("the credentials have changed, re-authenticating with method: %s", r.opts.vaultAuthOptions.Method)
+
+	if err := r.login(); err != nil {
+		r.opts.vaultAuthOptions = previous
+		return err
+	}
+
+	return nil
+}
+
+// AuthOptions returns the authentication options currently in use
+func (r *tokenManager) AuthOptions() *vaultAuthOptions {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.opts.vaultAuthOptions
+}
+
+// login performs the login, the lock must be held by the caller
+func (r *tokenManager) login() error {
+	auth, err := authenticate(r.client, r.opts, r.unwrapped)
+	if err != nil {
+		return err
+	}
+	if r.auth != nil && r.auth.ClientToken == auth.ClientToken {
+		glog.V(3).Infof("the authentication method returned the current token")
+	}
+	r.auth = auth
+	r.loginLease = time.Duration(auth.LeaseDuration) * time.Second
+	r.lastAuthenticated = time.Now()
+	r.exhausted = false
+	r.holdUntil = time.Time{}
+	r.setLease(auth)
+
+	glog.Infof("successfully authenticated with vault, renewable: %t, ttl: %s, policies: %v",
+		auth.Renewable, r.loginLease, auth.Policies)
+
+	r.upstream(TokenEvent{Auth: auth, ExpireTime: r.leaseExpireTime, Type: TokenEventLogin})
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// renew attempts to renew the current token, the lock must be held by the caller
+func (r *tokenManager) renew() error {
+	secret, err := r.client.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return err
+	}
+	auth, err := authFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if auth.ClientToken == "" {
+		auth.ClientToken = r.auth.ClientToken
+	}
+	remaining := time.Until(r.leaseExpireTime)
+	r.auth = auth
+	r.setLease(auth)
+
+	// step: if the lease was not extended, the token has reached its max ttl
+	lease := time.Duration(auth.LeaseDuration) * time.Second
+	if lease < r.loginLease && lease <= remaining+time.Second {
+		glog.Infof("the token has reached its max ttl, expires at: %s", r.leaseExpireTime)
+		r.exhausted = true
+	}
+	glog.Infof("successfully renewed the token, ttl: %s", lease)
+
+	r.upstream(TokenEvent{Auth: auth, ExpireTime: r.leaseExpireTime, Type: TokenEventRenewal})
+
+	return nil
+}
+
+// setLease updates the lease expiration of the token
+func (r *tokenManager) setLease(auth *api.SecretAuth) {
+	r.leaseExpireTime = time.Time{}
+	if auth.LeaseDuration > 0 {
+		r.leaseExpireTime = time.Now().Add(time.Duration(auth.LeaseDuration) * time.Second)
+	}
+}
+
+// nextAction returns the duration until the manager should next renew or login
+func (r *tokenManager) nextAction() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.auth == nil || r.leaseExpireTime.IsZero() {
+		return 0
+	}
+	next := time.Duration(float64(time.Until(r.leaseExpireTime)) * tokenRenewalFraction)
+	if !r.holdUntil.IsZero() {
+		next = time.Until(r.holdUntil)
+	}
+	if next < time.Second {
+		next = time.Second
+	}
+
+	return next
+}
+
+// run is the background routine which keeps the token alive
+func (r *tokenManager) run() {
+	var backoff time.Duration
+	for {
+		// step: wait until the token is due, unless we are retrying a failed refresh
+		if backoff == 0 {
+			next := r.nextAction()
+			if next <= 0 {
+				glog.V(3).Infof("the vault token has no lease, token renewal is not required")
+				<-r.wakeup
+				continue
+			}
+			glog.V(3).Infof("scheduling token renewal in %s", next)
+
+			select {
+			case <-r.wakeup:
+				continue
+			case <-time.After(next):
+			}
+		}
+
+		// step: on failure we back off exponentially, the authentication method may be unavailable for a while
+		if err := r.refresh(); err != nil {
+			backoff = r.backoff(backoff)
+			glog.Errorf("failed to refresh the vault token, retrying in %s, error: %s", backoff, err)
+			select {
+			case <-r.wakeup:
+				backoff = 0
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// refresh renews the token when possible, otherwise logs in again
+func (r *tokenManager) refresh() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.opts.vaultRenewToken && r.auth.Renewable && !r.exhausted {
+		glog.V(3).Infof("attempting to renew the vault token")
+		err := r.renew()
+		if err == nil || !isAuthError(err) {
+			return err
+		}
+		glog.Warningf("failed to renew the token, re-authenticating, error: %s", err)
+	}
+
+	// step: the authentication method may hand back the same token, i.e. a static token, in which case there
+	// is nothing we can do until the lease expires
+	previous := r.auth
+	if err := r.login(); err != nil {
+		return err
+	}
+	if previous.ClientToken == r.auth.ClientToken && !r.auth.Renewable && time.Until(r.leaseExpireTime) > 0 {
+		glog.Warningf("the authentication method returned the same non-renewable token, it expires at: %s", r.leaseExpireTime)
+		r.holdUntil = r.leaseExpireTime
+	}
+
+	return nil
+}
+
+// nextBackoff doubles the backoff between failed attempts, starting from a few seconds
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return getDurationWithin(3, 10)
+	}
+	backoff = backoff * 2
+	if backoff > maximumRefreshBackoff {
+		backoff = maximumRefreshBackoff
+	}
+
+	return backoff
+}
+
+// upstream sends the token event to the listeners, the lock must be held by the caller
+func (r *tokenManager) upstream(event TokenEvent) {
+	for _, listener := range r.listeners {
+		go func(ch chan TokenEvent) {
+			ch <- event
+		}(listener)
+	}
+}
+
+// authFromSecret extracts the authentication response from a login
+func authFromSecret(secret *api.Secret) (*api.SecretAuth, error) {
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("no authentication information returned by vault")
+	}
+
+	return secret.Auth, nil
+}
+
+// lookupTokenAuth builds an authentication response for an existing token
+func lookupTokenAuth(client *api.Client, token string) (*api.SecretAuth, error) {
+	client.SetToken(token)
+	auth := &api.SecretAuth{ClientToken: token}
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		if token == "" || !isAuthError(err) {
+			return nil, err
+		}
+		// step: the token may not be permitted to lookup itself, in which case we can't manage the lease; a revoked
+		// or expired token is denied as well though, so the token must still be able to check its own capabilities
+		if _, cerr := client.Sys().CapabilitiesSelf("auth/token/lookup-self"); cerr != nil {
+			return nil, fmt.Errorf("the token is not valid, error: %s", err)
+		}
+		glog.Warningf("unable to lookup the token, token renewal is disabled, error: %s", err)
+		return auth, nil
+	}
+	if ttl, err := secret.TokenTTL(); err == nil {
+		auth.LeaseDuration = int(ttl.Seconds())
+	}
+	if renewable, err := secret.TokenIsRenewable(); err == nil {
+		auth.Renewable = renewable
+	}
+	if accessor, err := secret.TokenAccessor(); err == nil {
+		auth.Accessor = accessor
+	}
+	if policies, err := secret.TokenPolicies(); err == nil {
+		auth.Policies = policies
+	}
+	if metadata, err := secret.TokenMetadata(); err == nil {
+		auth.Metadata = metadata
+	}
+
+	return auth, nil
+}
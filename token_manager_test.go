@@ -0,0 +1,157 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestVaultClient(t *testing.T, handler http.Handler) *api.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	require.NoError(t, err)
+	client.ClearToken()
+
+	return client
+}
+
+func TestLookupTokenAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "foobar", req.Header.Get("X-Vault-Token"))
+		fmt.Fprint(w, `{"data": {"accessor": "acc", "ttl": 3600, "renewable": true, "policies": ["default"]}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	auth, err := lookupTokenAuth(client, "foobar")
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, "acc", auth.Accessor)
+	assert.Equal(t, 3600, auth.LeaseDuration)
+	assert.True(t, auth.Renewable)
+	assert.Equal(t, []string{"default"}, auth.Policies)
+}
+
+func TestLookupTokenAuthDenied(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/sys/capabilities-self", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "restricted" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"capabilities": ["deny"], "auth/token/lookup-self": ["deny"]}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	// step: a revoked or expired token is rejected
+	_, err := lookupTokenAuth(client, "revoked")
+	assert.Error(t, err)
+
+	// step: a valid token without the policy to lookup itself is accepted, without a lease
+	auth, err := lookupTokenAuth(client, "restricted")
+	require.NoError(t, err)
+	assert.Equal(t, "restricted", auth.ClientToken)
+	assert.Zero(t, auth.LeaseDuration)
+}
+
+func TestTokenManagerRenewMaxTTL(t *testing.T) {
+	lease := 3600
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"auth": {"client_token": "foobar", "lease_duration": %d, "renewable": true}}`, lease)
+	})
+	client := newTestVaultClient(t, mux)
+
+	manager := newTokenManager(client, &config{vaultRenewToken: true})
+	manager.auth = &api.SecretAuth{ClientToken: "foobar", LeaseDuration: 3600, Renewable: true}
+	manager.loginLease = time.Hour
+	manager.leaseExpireTime = time.Now().Add(30 * time.Minute)
+
+	// step: a full renewal extends the token
+	require.NoError(t, manager.renew())
+	assert.False(t, manager.exhausted)
+
+	// step: a renewal capped by the max ttl
+	lease = 60
+	manager.leaseExpireTime = time.Now().Add(time.Minute)
+	require.NoError(t, manager.renew())
+	assert.True(t, manager.exhausted)
+}
+
+func TestTokenManagerLoginWithRetry(t *testing.T) {
+	logins := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, req *http.Request) {
+		if logins++; logins == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": ["invalid secret id"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 3600}}`)
+	})
+	client := newTestVaultClient(t, mux)
+
+	opts := &config{vaultAuthOptions: &vaultAuthOptions{Method: "approle", RoleID: "role", SecretID: "secret"}}
+	manager := newTokenManager(client, opts)
+	manager.backoff = func(time.Duration) time.Duration { return 10 * time.Millisecond }
+
+	// step: the first login fails and is retried
+	require.NoError(t, manager.LoginWithRetry(0))
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, "foobar", manager.Current().Auth.ClientToken)
+
+	// step: the login gives up once the attempts are exhausted
+	logins = 0
+	assert.Error(t, newTokenManager(client, opts).LoginWithRetry(1))
+	assert.Equal(t, 1, logins)
+
+	// step: a login which can't succeed isn't retried
+	opts = &config{vaultAuthOptions: &vaultAuthOptions{Method: "ldap"}}
+	t.Setenv("VAULT_SIDEKICK_USERNAME", "")
+	err := newTokenManager(client, opts).LoginWithRetry(0)
+	require.Error(t, err)
+	assert.True(t, isPermanentError(err))
+	opts.vaultAuthOptions.Method = "nosuch, github"
+	t.Setenv("VAULT_SIDEKICK_GITHUB_TOKEN", "")
+	err = newTokenManager(client, opts).LoginWithRetry(0)
+	require.Error(t, err)
+	assert.True(t, isPermanentError(err))
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := nextBackoff(0)
+	assert.True(t, backoff >= 3*time.Second && backoff < 10*time.Second)
+	assert.Equal(t, 2*backoff, nextBackoff(backoff))
+	assert.Equal(t, maximumRefreshBackoff, nextBackoff(maximumRefreshBackoff-time.Second))
+}
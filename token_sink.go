@@ -0,0 +1,140 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// tokenSink writes the sidekick's own vault token to a file for the application
+type tokenSink struct {
+	// the vault client
+	client *api.Client
+	// the file to write the token to
+	filename string
+	// the file permissions on the file
+	mode os.FileMode
+	// the format of the file, token or json
+	format string
+	// if set the token is response-wrapped with this ttl
+	wrapTTL time.Duration
+}
+
+// tokenSinkFile is the content of the token sink in json format
+type tokenSinkFile struct {
+	Token         string     `json:"token"`
+	Accessor      string     `json:"accessor,omitempty"`
+	Policies      []string   `json:"policies,omitempty"`
+	Renewable     bool       `json:"renewable"`
+	LeaseDuration int        `json:"lease_duration"`
+	ExpireTime    *time.Time `json:"expire_time,omitempty"`
+	Wrapped       bool       `json:"wrapped"`
+}
+
+// newTokenSink creates a token sink from the options
+func newTokenSink(client *api.Client, opts *config) *tokenSink {
+	return &tokenSink{
+		client:   client,
+		filename: opts.tokenSink,
+		mode:     opts.tokenSinkMode,
+		format:   opts.tokenSinkFormat,
+		wrapTTL:  opts.tokenSinkWrapTTL,
+	}
+}
+
+// watch writes the token on every event received
+func (r *tokenSink) watch(ch chan TokenEvent) {
+	for event := range ch {
+		if err := r.Write(event); err != nil {
+			glog.Errorf("failed to write the token sink: %s, error: %s", r.filename, err)
+		}
+	}
+}
+
+// Write writes the token to the sink
+func (r *tokenSink) Write(event TokenEvent) error {
+	if event.Auth == nil {
+		return fmt.Errorf("no token to write")
+	}
+	content := tokenSinkFile{
+		Token:         event.Auth.ClientToken,
+		Accessor:      event.Auth.Accessor,
+		Policies:      event.Auth.Policies,
+		Renewable:     event.Auth.Renewable,
+		LeaseDuration: event.Auth.LeaseDuration,
+	}
+	if !event.ExpireTime.IsZero() {
+		expireTime := event.ExpireTime.UTC()
+		content.ExpireTime = &expireTime
+	}
+
+	// step: are we wrapping the token
+	if r.wrapTTL > 0 {
+		wrapInfo, err := r.wrap(event.Auth.ClientToken)
+		if err != nil {
+			return err
+		}
+		expireTime := wrapInfo.CreationTime.Add(time.Duration(wrapInfo.TTL) * time.Second).UTC()
+		content = tokenSinkFile{
+			Token:         wrapInfo.Token,
+			Accessor:      wrapInfo.Accessor,
+			LeaseDuration: wrapInfo.TTL,
+			ExpireTime:    &expireTime,
+			Wrapped:       true,
+		}
+	}
+
+	data := []byte(content.Token)
+	if r.format == "json" {
+		encoded, err := json.MarshalIndent(content, "", "    ")
+		if err != nil {
+			return err
+		}
+		data = encoded
+	}
+	glog.V(3).Infof("writing the vault token to the sink: %s, wrapped: %t", r.filename, content.Wrapped)
+
+	// step: written atomically so the application never reads a partial token, a dry-run doesn't print the token
+	return writeFileAtomic(r.filename, data, r.mode)
+}
+
+// wrap response-wraps the token
+func (r *tokenSink) wrap(token string) (*api.SecretWrapInfo, error) {
+	clone, err := r.client.CloneWithHeaders()
+	if err != nil {
+		return nil, err
+	}
+	clone.SetToken(token)
+	clone.SetWrappingLookupFunc(func(operation, path string) string {
+		return r.wrapTTL.String()
+	})
+	secret, err := clone.Logical().Write("sys/wrapping/wrap", map[string]interface{}{"token": token})
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap the token, error: %s", err)
+	}
+	if secret == nil || secret.WrapInfo == nil {
+		return nil, fmt.Errorf("no wrapping information returned by vault")
+	}
+
+	return secret.WrapInfo, nil
+}
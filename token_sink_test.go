@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSinkWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(filename, []byte("previous"), 0644))
+	sink := &tokenSink{filename: filename, mode: 0600, format: "token"}
+	event := TokenEvent{
+		Auth:       &api.SecretAuth{ClientToken: "foobar", Accessor: "acc", LeaseDuration: 60, Renewable: true},
+		ExpireTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	require.NoError(t, sink.Write(event))
+	content, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", string(content))
+	stat, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	sink.format = "json"
+	require.NoError(t, sink.Write(event))
+	content, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	var decoded tokenSinkFile
+	require.NoError(t, json.Unmarshal(content, &decoded))
+	assert.Equal(t, "foobar", decoded.Token)
+	assert.Equal(t, "acc", decoded.Accessor)
+	assert.Equal(t, event.ExpireTime, *decoded.ExpireTime)
+	assert.False(t, decoded.Wrapped)
+
+	// step: a dry-run leaves the sink alone
+	options.dryRun = true
+	defer func() { options.dryRun = false }()
+	event.Auth.ClientToken = "dry-run"
+	require.NoError(t, sink.Write(event))
+	content, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "dry-run")
+}
+
+func TestTokenSinkWriteWrapped(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/wrapping/wrap", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "5m0s", req.Header.Get("X-Vault-Wrap-TTL"))
+		assert.Equal(t, "foobar", req.Header.Get("X-Vault-Token"))
+		assert.Equal(t, "team-a", req.Header.Get("X-Vault-Namespace"))
+		fmt.Fprint(w, `{"wrap_info": {"token": "wrapped", "accessor": "wacc", "ttl": 300, "creation_time": "2020-01-01T00:00:00Z"}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	client.SetNamespace("team-a")
+
+	filename := filepath.Join(t.TempDir(), "token")
+	sink := &tokenSink{client: client, filename: filename, mode: 0600, format: "json", wrapTTL: 5 * time.Minute}
+	require.NoError(t, sink.Write(TokenEvent{Auth: &api.SecretAuth{ClientToken: "foobar"}}))
+
+	content, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	var decoded tokenSinkFile
+	require.NoError(t, json.Unmarshal(content, &decoded))
+	assert.Equal(t, "wrapped", decoded.Token)
+	assert.True(t, decoded.Wrapped)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC), *decoded.ExpireTime)
+}
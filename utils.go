@@ -58,6 +58,18 @@ func hasKey(key string, data map[string]interface{}) bool {
 	return found
 }
 
+// contains checks to see if a value is in the list
+//	value		: the value we are looking for
+//	list		: the list of strings we are looking in
+func contains(value string, list []string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
 // getKeys retrieves a list of keys from the map
 // 	data		: the map which you wish to extract the keys from
 func getKeys(data map[string]interface{}) []string {
@@ -201,6 +213,8 @@ func processResource(rn *VaultResource, data map[string]interface{}) (err error)
 		err = writeTemplateFile(filename, data, rn.fileMode, rn.templateFile)
 	case "aws":
 		err = writeAwsCredentialFile(filename, data, rn.fileMode)
+	case "pkcs12", "jks":
+		err = writeKeystoreFile(filename, data, rn.fileMode, rn.resource, rn.format, rn.keystoreAlias)
 	default:
 		return fmt.Errorf("unknown output format: %s", rn.format)
 	}
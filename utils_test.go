@@ -121,3 +121,17 @@ func TestGetDurationWithin(t *testing.T) {
 		t.Errorf("Expected duration to be higher than 0 got %d", duration)
 	}
 }
+
+func TestReadConfigGitHubYAML(t *testing.T) {
+	o, err := readConfigFile("tests/github_auth_file.yml", "default")
+	if err != nil {
+		t.Errorf("raising an error: %v", err)
+	}
+
+	if o.GitHubToken != "foobar" {
+		t.Errorf("Expected token %s got %s", "foobar", o.GitHubToken)
+	}
+	if o.Mount != "github-org" {
+		t.Errorf("Expected mount %s got %s", "github-org", o.Mount)
+	}
+}
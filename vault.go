@@ -19,13 +19,14 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"time"
-
+	"path"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/hashicorp/vault/api"
@@ -33,8 +34,8 @@ import (
 
 // AuthInterface is the authentication interface
 type AuthInterface interface {
-	// Create and handle renewals of the token
-	Create(*vaultAuthOptions) (string, error)
+	// Create logs into vault and returns the authentication response
+	Create(*vaultAuthOptions) (*api.SecretAuth, error)
 }
 
 // VaultService is the main interface into the vault API - placing into a structure
@@ -45,12 +46,14 @@ type VaultService struct {
 	client *api.Client
 	// the vault config
 	config *api.Config
-	// the token to authenticate with
-	token string
+	// the token manager
+	tokens *tokenManager
 	// the listener channel - technically we only have the one listener but there a long term reasons for adding this
 	listeners []chan VaultEvent
 	// a channel to inform of a new resource to processor
 	resourceChannel chan *watchedResource
+	// the delay before a failed resource is retried for the nth time, defaults to a backoff from 3-10 seconds
+	retryDelay func(retries int) time.Duration
 }
 
 // VaultEvent is the definition which captures a change
@@ -72,7 +75,8 @@ const (
 
 // NewVaultService creates a new implementation to speak to vault and retrieve the resources
 //	url			: the url of the vault service
-func NewVaultService(url string) (*VaultService, error) {
+//	tokenListeners		: listeners of the token events, added before the token is first renewed
+func NewVaultService(url string, tokenListeners ...chan TokenEvent) (*VaultService, error) {
 	var err error
 
 	// step: create the config for client
@@ -89,6 +93,26 @@ func NewVaultService(url string) (*VaultService, error) {
 		return nil, err
 	}
 
+	// step: authenticate the client and start managing the token
+	service.tokens = newTokenManager(service.client, &options)
+	for _, listener := range tokenListeners {
+		service.tokens.AddListener(listener)
+	}
+	// step: running once, i.e. as an init container, we give up rather than wait forever
+	attempts := 0
+	if options.oneShot || options.requestToken {
+		attempts = oneShotLoginAttempts
+	}
+	if err = service.tokens.LoginWithRetry(attempts); err != nil {
+		return nil, err
+	}
+	go service.tokens.run()
+
+	// step: login again whenever the auth file or credential files are changed on disk
+	if options.authReloadInterval > 0 {
+		go newCredentialWatcher(service.tokens, &options).run(options.authReloadInterval)
+	}
+
 	// step: start the service processor off
 	service.vaultServiceProcessor()
 
@@ -142,18 +166,29 @@ func (r *VaultService) vaultServiceProcessor() {
 					break
 				}
 
-				// step: save the current lease if we have one
-				leaseID := ""
+				// step: save the current lease and certificate serial if we have one
+				leaseID, serial := "", ""
 				if x.secret != nil && x.secret.LeaseID != "" {
 					leaseID = x.secret.LeaseID
 					glog.V(10).Infof("resource: %s has a previous lease: %s", x.resource, leaseID)
 				}
+				var previous map[string]interface{}
+				if x.secret != nil && x.resource.resource == "pki" {
+					previous = x.secret.Data
+					serial, _ = previous["serial_number"].(string)
+				}
 
 				err := r.get(x)
 				if err != nil {
 					glog.Errorf("failed to retrieve the resource: %s from vault, error: %s", x.resource, err)
+					// step: if the token is no longer valid, we authenticate again before the retry
+					if isAuthError(err) {
+						if err := r.tokens.Reauthenticate(); err != nil {
+							glog.Errorf("failed to re-authenticate with vault, error: %s", err)
+						}
+					}
 					// reschedule the attempt for later
-					r.scheduleIn(x, retrieveChannel, getDurationWithin(3, 10))
+					r.scheduleIn(x, retrieveChannel, r.retryIn(x.resource.retries))
 					x.resource.retries++
 					r.upstream(VaultEvent{
 						Resource: x.resource,
@@ -165,21 +200,48 @@ func (r *VaultService) vaultServiceProcessor() {
 				glog.V(4).Infof("successfully retrieved resource: %s, leaseID: %s", x.resource, x.secret.LeaseID)
 				x.resource.retries = 0
 
-				// step: if we had a previous lease and the option is to revoke, lets throw into the revoke channel
-				if leaseID != "" && x.resource.revoked {
-					// step: make a rough copy
+				// step: if we had a previous certificate and the option is to revoke, the certificate is revoked by its
+				// serial as it may not have a lease
+				if serial != "" && x.resource.revoked && serial != x.secret.Data["serial_number"] {
 					copy := &watchedResource{
+						resource: x.resource,
 						secret: &api.Secret{
-							LeaseID: x.secret.LeaseID,
+							Data: map[string]interface{}{
+								"serial_number": serial,
+								"private_key":   previous["private_key"],
+							},
+						},
+					}
+
+					r.scheduleIn(copy, revokeChannel, x.resource.revokeDelay)
+				} else if leaseID != "" && x.resource.revoked && leaseID != x.secret.LeaseID {
+					// step: if we had a previous lease and the option is to revoke, lets throw into the revoke channel
+					copy := &watchedResource{
+						resource: x.resource,
+						secret: &api.Secret{
+							LeaseID: leaseID,
 						},
 					}
 
 					r.scheduleIn(copy, revokeChannel, x.resource.revokeDelay)
 				}
+				// step: a template revokes the leases of the secrets it has read again or no longer references
+				for _, lease := range x.superseded {
+					if x.resource.revoked {
+						r.scheduleIn(&watchedResource{resource: x.resource, secret: &api.Secret{LeaseID: lease}}, revokeChannel, x.resource.revokeDelay)
+					}
+				}
+				x.superseded = nil
 
 				// step: setup a timer for renewal
 				x.notifyOnRenewal(renewChannel)
 
+				// step: there is nothing to write out if the resource has not changed
+				if !x.changed {
+					glog.V(4).Infof("resource: %s has not changed, skipping the update", x.resource)
+					break
+				}
+
 				// step: update the upstream consumers
 				r.upstream(VaultEvent{
 					Resource: x.resource,
@@ -223,15 +285,19 @@ func (r *VaultService) vaultServiceProcessor() {
 					if err != nil {
 						// bad request errors won't be fixed via a retry they can happen if the resource (or its lease) is revoked
 						// permission errors won't be fixed via a retry they can happen if the token (or its lease) is revoked
-						if strings.Contains(err.Error(), "Code: 400") ||
-							strings.Contains(err.Error(), "Code: 403") {
+						if strings.Contains(err.Error(), "Code: 400") || isAuthError(err) {
 							glog.Errorf("failed to renew the resource: %s for renewal, retrieving a new lease instead, error: %s", x.resource, err)
+							if isAuthError(err) {
+								if err := r.tokens.Reauthenticate(); err != nil {
+									glog.Errorf("failed to re-authenticate with vault, error: %s", err)
+								}
+							}
 							r.scheduleNow(x, retrieveChannel)
 							break
 						}
 						glog.Errorf("failed to renew the resource: %s for renewal, error: %s", x.resource, err)
 						// reschedule the attempt for later
-						r.scheduleIn(x, renewChannel, getDurationWithin(3, 10))
+						r.scheduleIn(x, renewChannel, r.retryIn(x.resource.retries))
 						x.resource.retries++
 						r.upstream(VaultEvent{
 							Resource: x.resource,
@@ -263,9 +329,9 @@ func (r *VaultService) vaultServiceProcessor() {
 
 			// We receive a lease ID along on the channel, just revoke the lease when you can
 			case x := <-revokeChannel:
-				err := r.revoke(x.secret.LeaseID)
+				err := r.revoke(x)
 				if err != nil {
-					glog.Errorf("failed to revoke the lease: %s, error: %s", x.secret.LeaseID, err)
+					glog.Errorf("failed to revoke the resource: %s, error: %s", x.resource, err)
 				}
 
 			// The statistics timer has gone off; we iterate the watched items and
@@ -303,6 +369,23 @@ func (r VaultService) scheduleIn(rn *watchedResource, ch chan *watchedResource,
 	}(rn)
 }
 
+// retryIn returns the time to wait before a failed resource is retried, doubling with each retry so a resource
+// which keeps failing, i.e. is denied by policy, backs off up to the maximum
+func (r VaultService) retryIn(retries int) time.Duration {
+	if r.retryDelay != nil {
+		return r.retryDelay(retries)
+	}
+	delay := getDurationWithin(3, 10)
+	for i := 0; i < retries && delay < maximumRefreshBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maximumRefreshBackoff {
+		delay = maximumRefreshBackoff
+	}
+
+	return delay
+}
+
 // upstream ... the resource has changed thus we notify the upstream listener
 //	item		: the item which has changed
 func (r VaultService) upstream(item VaultEvent) {
@@ -322,8 +405,11 @@ func (r VaultService) renew(rn *watchedResource) error {
 	if !rn.secret.Renewable {
 		return fmt.Errorf("the resource: %s is not renewable", rn.resource)
 	}
+	if rn.resource.resource == "tpl" {
+		return r.renewTemplate(rn)
+	}
 
-	secret, err := r.client.Sys().Renew(rn.secret.LeaseID, 0)
+	secret, err := r.clientFor(rn.resource).Sys().Renew(rn.secret.LeaseID, 0)
 	if err != nil {
 		return err
 	}
@@ -340,11 +426,16 @@ func (r VaultService) renew(rn *watchedResource) error {
 }
 
 // revoke attempts to revoke the lease of a resource
-//	lease		: the lease lease which was given when you got it
-func (r VaultService) revoke(lease string) error {
+//	rn			: the resource holding the lease which was given when you got it
+func (r VaultService) revoke(rn *watchedResource) error {
+	if serial, found := rn.secret.Data["serial_number"].(string); found && rn.resource.resource == "pki" {
+		return revokeCertificate(r.clientFor(rn.resource), rn.resource, serial, rn.secret.Data["private_key"])
+	}
+
+	lease := rn.secret.LeaseID
 	glog.V(3).Infof("attemping to revoking the lease: %s", lease)
 
-	err := r.client.Sys().Revoke(lease)
+	err := r.clientFor(rn.resource).Sys().Revoke(lease)
 	if err != nil {
 		return err
 	}
@@ -358,6 +449,8 @@ func (r VaultService) revoke(lease string) error {
 func (r VaultService) get(rn *watchedResource) error {
 	var err error
 	var secret *api.Secret
+	// a resource is assumed to have changed unless the read says otherwise
+	changed := true
 	// step: not sure who to cast map[string]string to map[string]interface{} doesn't like it anyway i try and do it
 
 	params := make(map[string]interface{}, 0)
@@ -367,14 +460,15 @@ func (r VaultService) get(rn *watchedResource) error {
 	glog.V(10).Infof("resource: %s, path: %s, params: %v", rn.resource.resource, rn.resource.path, params)
 
 	glog.V(5).Infof("attempting to retrieve the resource: %s from vault", rn.resource)
+	client := r.clientFor(rn.resource)
 	// step: perform a request to vault
 	switch rn.resource.resource {
 	case "raw":
-		request := r.client.NewRequest("GET", "/v1/"+rn.resource.path)
+		request := client.NewRequest("GET", "/v1/"+rn.resource.path)
 		for k, v := range rn.resource.options {
 			request.Params.Add(k, v)
 		}
-		resp, err := r.client.RawRequest(request)
+		resp, err := client.RawRequest(request)
 		if err != nil {
 			return err
 		}
@@ -396,41 +490,8 @@ func (r VaultService) get(rn *watchedResource) error {
 		} else {
 			secret.LeaseDuration = int((time.Duration(24) * time.Hour).Seconds())
 		}
-	case "pki":
-		secret, err = r.client.Logical().Write(fmt.Sprintf(rn.resource.path), params)
-	case "transit":
-		secret, err = r.client.Logical().Write(fmt.Sprintf(rn.resource.path), params)
-	case "aws":
-		fallthrough
-	case "cubbyhole":
-		fallthrough
-	case "gcp":
-		fallthrough
-	case "mysql":
-		fallthrough
-	case "postgres":
-		fallthrough
-	case "database":
-		fallthrough
 	case "secret":
-		secret, err = r.client.Logical().Read(rn.resource.path)
-		// We must generate the secret if we have the create flag
-		if rn.resource.create && secret == nil && err == nil {
-			glog.V(3).Infof("Create param specified, creating resource: %s", rn.resource.path)
-			params["value"] = newPassword(int(rn.resource.size))
-			secret, err = r.client.Logical().Write(fmt.Sprintf(rn.resource.path), params)
-			glog.V(3).Infof("Secret created: %s", rn.resource.path)
-			if err == nil {
-				// Populate the secret data as stored in Vault...
-				secret, err = r.client.Logical().Read(rn.resource.path)
-			}
-		}
-		// if there is a top-level metadata key this is from a v2 kv store
-		if err == nil && secret != nil {
-			if _, ok := secret.Data["metadata"]; ok {
-				secret.Data = secret.Data["data"].(map[string]interface{})
-			}
-		}
+		secret, changed, err = r.readSecret(rn, client)
 	case "ssh":
 		publicKeyData, err := ioutil.ReadFile(params["public_key_path"].(string))
 
@@ -445,14 +506,22 @@ func (r VaultService) get(rn *watchedResource) error {
 			"cert_type":  params["cert_type"].(string),
 		}
 
-		secret, err = r.client.Logical().Write(fmt.Sprintf(rn.resource.path), sshParams)
+		secret, err = client.Logical().Write(rn.resource.path, sshParams)
+	case "tpl":
+		secret, err = r.renderTemplate(rn)
+	case "pki-ca":
+		secret, err = readCABundle(client, rn.resource)
+	case "pki":
+		if rn.resource.csr {
+			secret, err = signCertificate(client, rn.resource, params)
+		} else {
+			secret, err = logical(client, rn.resource, params)
+		}
+	default:
+		secret, err = logical(client, rn.resource, params)
 	}
 	// step: check the error if any
 	if err != nil {
-		if strings.Contains(err.Error(), "missing client token") {
-			// decision: until the rewrite, lets just exit for now
-			glog.Fatalf("the vault token is no longer valid, exitting, error: %s", err)
-		}
 		return err
 	}
 	if secret == nil && err == nil {
@@ -463,6 +532,21 @@ func (r VaultService) get(rn *watchedResource) error {
 		return fmt.Errorf("unable to retrieve the secret")
 	}
 
+	// step: the password of a keystore is resolved with each certificate, so it can be rotated along with it
+	if rn.resource.isKeystore() {
+		password, err := r.keystorePassword(rn, client)
+		if err != nil {
+			return err
+		}
+		secret.Data[keystorePasswordKey] = password
+	}
+
+	// step: a resource is only written out again when it changes, a template or ca bundle when the content changes
+	rn.changed = changed
+	if (rn.resource.resource == "tpl" || rn.resource.resource == "pki-ca") && rn.secret != nil {
+		rn.changed = rn.secret.Data["content"] != secret.Data["content"]
+	}
+
 	// step: update the watched resource
 	rn.lastUpdated = time.Now()
 	rn.secret = secret
@@ -475,10 +559,31 @@ func (r VaultService) get(rn *watchedResource) error {
 	return err
 }
 
-// newVaultClient creates and authenticates a vault client
+// logical performs the request for a resource against any secret engine, with the verb of the resource or the
+// default verb for its type; the options of the resource are passed as parameters
+func logical(client *api.Client, rn *VaultResource, params map[string]interface{}) (*api.Secret, error) {
+	switch rn.getVerb() {
+	case "write":
+		return client.Logical().Write(rn.path, params)
+	case "list":
+		return client.Logical().List(rn.path)
+	default:
+		// step: the presets have always read the path as is, only a logical resource or an explicit verb passes
+		// the options as query parameters
+		if rn.resource != "logical" && rn.verb == "" {
+			return client.Logical().Read(rn.path)
+		}
+		data := make(map[string][]string, len(params))
+		for k, v := range params {
+			data[k] = []string{fmt.Sprintf("%v", v)}
+		}
+		return client.Logical().ReadWithData(rn.path, data)
+	}
+}
+
+// newVaultClient creates a vault client
 func newVaultClient(opts *config) (*api.Client, error) {
 	var err error
-	var token string
 
 	config := api.DefaultConfig()
 	config.Address = opts.vaultURL
@@ -493,78 +598,149 @@ func newVaultClient(opts *config) (*api.Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	if opts.vaultNamespace != "" {
+		client.SetNamespace(opts.vaultNamespace)
+	}
+
+	return client, nil
+}
+
+// clientFor returns a client for the resource, switching to the namespace of the resource if it has one;
+// a namespace is relative to the global namespace unless prefixed with a slash
+func (r VaultService) clientFor(rn *VaultResource) *api.Client {
+	if rn == nil || rn.namespace == "" {
+		return r.client
+	}
+
+	return r.client.WithNamespace(resolveNamespace(options.vaultNamespace, rn.namespace))
+}
+
+// resolveNamespace resolves the namespace of a resource against the global namespace
+func resolveNamespace(global, namespace string) string {
+	if strings.HasPrefix(namespace, "/") {
+		return strings.Trim(namespace, "/")
+	}
+
+	return strings.Trim(path.Join(global, namespace), "/")
+}
+
+// authenticate logs into vault with the configured authentication plugins and sets the token on the client; the
+// methods are tried in the order given and the first one to succeed is used
+func authenticate(client *api.Client, opts *config, unwrapped *unwrapCache) (*api.SecretAuth, error) {
+	methods := authMethods(opts.vaultAuthOptions.Method)
+	if len(methods) == 0 {
+		methods = []string{opts.vaultAuthOptions.Method}
+	}
+
+	var failures []string
+	retryable := false
+	for _, method := range methods {
+		// step: each attempt logs in on a copy of the client, as the current token is still in use by the
+		// resources until a login succeeds
+		attempt, err := client.CloneWithHeaders()
+		if err != nil {
+			return nil, err
+		}
+		attempt.ClearToken()
+		auth, err := authenticateWith(attempt, opts, method, unwrapped)
+		if err == nil {
+			if len(methods) > 1 {
+				glog.Infof("successfully authenticated with method: %s", method)
+			}
+			client.SetToken(auth.ClientToken)
+			return auth, nil
+		}
+		if len(methods) == 1 {
+			return nil, err
+		}
+		glog.Warningf("failed to authenticate with method: %s, trying the next method, error: %s", method, err)
+		failures = append(failures, fmt.Sprintf("%s: %s", method, err))
+		retryable = retryable || !isPermanentError(err)
+	}
+	err := fmt.Errorf("all the authentication methods failed, %s", strings.Join(failures, ", "))
+	if !retryable {
+		return nil, permanent(err)
+	}
+
+	return nil, err
+}
+
+// authenticateWith logs into vault with the authentication plugin and sets the token on the client
+func authenticateWith(client *api.Client, opts *config, plugin string, unwrapped *unwrapCache) (*api.SecretAuth, error) {
+	var err error
+	var auth *api.SecretAuth
 
-	plugin := opts.vaultAuthOptions.Method
 	switch plugin {
 	case "userpass":
-		token, err = NewUserPassPlugin(client).Create(opts.vaultAuthOptions)
+		auth, err = NewUserPassPlugin(client).Create(opts.vaultAuthOptions)
+	case "ldap":
+		auth, err = NewLDAPPlugin(client).Create(opts.vaultAuthOptions)
+	case "github":
+		auth, err = NewGitHubPlugin(client).Create(opts.vaultAuthOptions)
 	case "approle":
-		token, err = NewAppRolePlugin(client).Create(opts.vaultAuthOptions)
+		auth, err = NewAppRolePlugin(client, unwrapped).Create(opts.vaultAuthOptions)
 	case "aws-ec2":
-		token, err = NewAWSEC2Plugin(client).Create(opts.vaultAuthOptions)
+		auth, err = NewAWSEC2Plugin(client).Create(opts.vaultAuthOptions)
+	case "aws-iam":
+		auth, err = NewAWSIAMPlugin(client).Create(opts.vaultAuthOptions)
 	case "gcp-gce":
-		token, err = NewGCPGCEPlugin(client).Create(opts.vaultAuthOptions)
+		auth, err = NewGCPGCEPlugin(client).Create(opts.vaultAuthOptions)
+	case "azure":
+		auth, err = NewAzurePlugin(client).Create(opts.vaultAuthOptions)
 	case "kubernetes":
-		token, err = NewKubernetesPlugin(client).Create(opts.vaultAuthOptions)
+		auth, err = NewKubernetesPlugin(client).Create(opts.vaultAuthOptions)
+	case "jwt":
+		auth, err = NewJWTPlugin(client).Create(opts.vaultAuthOptions)
+	case "cert":
+		auth, err = NewCertPlugin(client).Create(opts.vaultAuthOptions)
 	case "token":
-		opts.vaultAuthOptions.FileName = options.vaultAuthFile
-		opts.vaultAuthOptions.FileFormat = options.vaultAuthFileFormat
-		token, err = NewUserTokenPlugin(client).Create(opts.vaultAuthOptions)
+		opts.vaultAuthOptions.FileName = opts.vaultAuthFile
+		opts.vaultAuthOptions.FileFormat = opts.vaultAuthFileFormat
+		auth, err = NewUserTokenPlugin(client, unwrapped).Create(opts.vaultAuthOptions)
 	default:
-		return nil, fmt.Errorf("unsupported authentication plugin: %s", plugin)
+		return nil, permanent(fmt.Errorf("unsupported authentication plugin: %s", plugin))
 	}
 	if err != nil {
 		return nil, err
 	}
+	if auth == nil || auth.ClientToken == "" {
+		return nil, fmt.Errorf("the authentication plugin: %s did not return a token", plugin)
+	}
 
 	// step: set the token for the client
-	client.SetToken(token)
+	client.SetToken(auth.ClientToken)
 
-	if opts.vaultRenewToken {
+	return auth, nil
+}
 
-		tokeninfo, err := client.Auth().Token().LookupSelf()
-		if err != nil {
-			return nil, fmt.Errorf("failed to lookup token info: %s", err)
-		}
+// permanentError is a login failure which retrying won't fix, i.e. an unsupported method or a missing input
+type permanentError struct {
+	error
+}
 
-		tokenttl, err := tokeninfo.TokenTTL()
-		if err != nil {
-			return nil, fmt.Errorf("failed to lookup token ttl: %s", err)
-		}
-		glog.Infof("token ttl is %v", tokenttl)
-		renewPeriod := tokenttl / 2
-		go func() {
-			for {
-				if renewPeriod < 1*time.Second {
-					glog.Fatalf("fatal: token renew period is <1s, aborting")
-				}
-				glog.Infof("scheduling token renew in %v", renewPeriod)
-				<-time.After(renewPeriod)
+// permanent marks the error as one which retrying won't fix
+func permanent(err error) error {
+	return permanentError{err}
+}
 
-				glog.Infof("attempting token renew")
-				newtokeninfo, err := client.Auth().Token().RenewSelf(0)
-				if err != nil {
-					// permission errors won't be fixed via a retry they can happen if the token (or its lease) is revoked
-					if strings.Contains(err.Error(), "Code: 403") {
-						glog.Fatalf("fatal: failed to renew token: %v", err)
-					}
-					renewPeriod = renewPeriod / 2
-					glog.Warningf("error: failed to renew token, retrying in %v: %v", renewPeriod, err)
-					continue
-				}
+// isPermanentError checks if the error is one which retrying won't fix
+func isPermanentError(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
 
-				tokenttl, err := newtokeninfo.TokenTTL()
-				if err != nil {
-					glog.Warningf("error: failed to get new token ttl, using previous value %s: %s", renewPeriod, err)
-				} else {
-					glog.Infof("token ttl is %v", tokenttl)
-					renewPeriod = tokenttl / 2
-				}
-			}
-		}()
+// isAuthError checks if the error from vault indicates the token is missing or no longer valid
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+		return true
 	}
 
-	return client, nil
+	return strings.Contains(err.Error(), "missing client token") ||
+		strings.Contains(err.Error(), "Code: 403")
 }
 
 // buildHTTPTransport constructs a http transport for the http client
@@ -595,6 +771,15 @@ func buildHTTPTransport(opts *config) (*http.Transport, error) {
 		caCertPool.AppendCertsFromPEM(caCert)
 		transport.TLSClientConfig.RootCAs = caCertPool
 	}
+	// step: are we presenting a client certificate
+	if opts.vaultClientCert != "" {
+		glog.V(3).Infof("loading the client certificate: %s", opts.vaultClientCert)
+		reloader, err := newKeyPairReloader(opts.vaultClientCert, opts.vaultClientKey)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
 
 	return transport, nil
 }
@@ -54,12 +54,36 @@ const (
 	optionMaxJitter = "jitter"
 	// optionTtl specifies requested Time To Live for use with the PKI Backend
 	optionTtl = "ttl"
+	// optionNamespace is the vault enterprise namespace of the resource
+	optionNamespace = "ns"
+	// optionVersion pins the version of a kv version 2 secret
+	optionVersion = "version"
+	// optionMetadata adds the kv metadata of the secret to the resource
+	optionMetadata = "metadata"
+	// optionFields is the list of fields generated when creating a secret
+	optionFields = "fields"
+	// optionCSR generates the private key of a certificate locally and has vault sign a request for it
+	optionCSR = "csr"
+	// optionRenewFraction is how far through its validity a certificate is issued again
+	optionRenewFraction = "renew_fraction"
+	// optionRevokeWithKey revokes a superseded certificate with its private key rather than the serial alone
+	optionRevokeWithKey = "revoke_with_key"
+	// optionVerb is the verb (read, write or list) used to retrieve the resource
+	optionVerb = "verb"
+	// optionAlias is the alias of the certificate in a keystore
+	optionAlias = "alias"
+	// optionKeystorePassword is the password of a keystore
+	optionKeystorePassword = "keystore_password"
+	// optionKeystorePasswordEnv is the environment variable holding the password of a keystore
+	optionKeystorePasswordEnv = "keystore_password_env"
+	// optionKeystorePasswordSecret is the vault secret holding the password of a keystore, i.e. secret/app#password
+	optionKeystorePasswordSecret = "keystore_password_secret"
 	// defaultSize sets the default size of a generic secret
 	defaultSize = 20
 )
 
 var (
-	resourceFormatRegex = regexp.MustCompile("^(yaml|yml|json|env|ini|txt|cert|bundle|csv|template|credential|aws)$")
+	resourceFormatRegex = regexp.MustCompile("^(yaml|yml|json|env|ini|txt|cert|bundle|csv|template|credential|aws|pkcs12|jks)$")
 
 	// a map of valid resource to retrieve from vault
 	validResources = map[string]bool{
@@ -76,6 +100,15 @@ var (
 		"cassandra": true,
 		"ssh":       true,
 		"database":  true,
+		"logical":   true,
+		"pki-ca":    true,
+	}
+
+	// the verb used to retrieve each type of resource, the others are read
+	resourceVerbs = map[string]string{
+		"pki":     "write",
+		"transit": "write",
+		"ssh":     "write",
 	}
 )
 
@@ -131,6 +164,30 @@ type VaultResource struct {
 	maxJitter time.Duration
 	// specifies requested Time To Live for use with the PKI Backend
 	ttl string
+	// the vault enterprise namespace of the resource, relative to the global namespace
+	namespace string
+	// the verb used to retrieve the resource, overriding the default of the type
+	verb string
+	// the version of a kv version 2 secret, zero for the latest
+	version int
+	// whether the kv metadata is added to the resource
+	kvMetadata bool
+	// the fields generated when creating the secret
+	fields []string
+	// whether the private key of a certificate is generated locally
+	csr bool
+	// the fraction of the validity of a certificate after which it is issued again
+	renewFraction float64
+	// whether a superseded certificate is revoked with its private key
+	revokeWithKey bool
+	// the alias of the certificate in a keystore
+	keystoreAlias string
+	// the password of a keystore
+	keystorePassword string
+	// the environment variable holding the password of a keystore
+	keystorePasswordEnv string
+	// the vault secret holding the password of a keystore
+	keystorePasswordSecret string
 }
 
 // GetFilename generates a resource filename by default the resource name and resource type, which
@@ -143,6 +200,23 @@ func (r VaultResource) GetFilename() string {
 	return fmt.Sprintf("%s.%s", r.path, r.resource)
 }
 
+// getVerb returns the verb used to retrieve the resource, read, write or list
+func (r VaultResource) getVerb() string {
+	if r.verb != "" {
+		return r.verb
+	}
+	if verb, found := resourceVerbs[r.resource]; found {
+		return verb
+	}
+
+	return "read"
+}
+
+// isKeystore checks if the resource is written out as a keystore
+func (r VaultResource) isKeystore() bool {
+	return r.format == "pkcs12" || r.format == "jks"
+}
+
 // IsValid checks to see if the resource is valid
 func (r *VaultResource) IsValid() error {
 	// step: check the resource type
@@ -160,17 +234,33 @@ func (r *VaultResource) IsValid() error {
 
 // isValidResource validates the resource meets the requirements
 func (r *VaultResource) isValidResource() error {
+	switch r.resource {
+	case "raw", "secret", "ssh", "tpl", "pki-ca":
+		if r.verb != "" {
+			return fmt.Errorf("the verb option is not supported by the %s resource", r.resource)
+		}
+	}
+
+	if r.isKeystore() && r.resource != "pki" && r.resource != "pki-ca" {
+		return fmt.Errorf("the %s format is only supported by the pki and pki-ca resources", r.format)
+	}
+
 	switch r.resource {
 	case "pki":
 		if _, found := r.options["common_name"]; !found {
 			return fmt.Errorf("pki resource requires a common name specified")
 		}
+		if r.csr {
+			if _, _, err := pkiKeyOptions(r.options); err != nil {
+				return err
+			}
+		}
 	case "transit":
 		if _, found := r.options["ciphertext"]; !found {
 			return fmt.Errorf("transit requires a ciphertext option")
 		}
 	case "tpl":
-		if _, found := r.options[optionTemplatePath]; !found {
+		if r.templateFile == "" {
 			return fmt.Errorf("template resource requires a template path option")
 		}
 	case "ssh":
@@ -188,6 +278,9 @@ func (r *VaultResource) isValidResource() error {
 // String returns a string representation of the struct
 func (r VaultResource) String() string {
 	str := fmt.Sprintf("type: %s, path: %s", r.resource, r.path)
+	if r.namespace != "" {
+		str = fmt.Sprintf("%s, namespace: %s", str, r.namespace)
+	}
 	if r.maxRetries > 0 {
 		str = fmt.Sprintf("%s, attempts: %d/%d", str, r.retries, r.maxRetries+1)
 	}
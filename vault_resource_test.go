@@ -43,4 +43,8 @@ func TestIsValid(t *testing.T) {
 	assert.NotNil(t, resource.IsValid())
 	resource.resource = "ssh"
 	assert.NotNil(t, resource.IsValid())
+	resource.resource = "tpl"
+	assert.NotNil(t, resource.IsValid())
+	resource.templateFile = "/etc/templates/db.tmpl"
+	assert.Nil(t, resource.IsValid())
 }
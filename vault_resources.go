@@ -53,6 +53,7 @@ func (r *VaultResources) Set(value string) error {
 	rn.resource = items[0]
 	rn.path = items[1]
 	rn.options = make(map[string]string, 0)
+	formatSet := false
 
 	// step: extract any options
 	if len(items) > 2 {
@@ -87,6 +88,7 @@ func (r *VaultResources) Set(value string) error {
 					return fmt.Errorf("unsupported output format: %s", value)
 				}
 				rn.format = value
+				formatSet = true
 			case optionUpdate:
 				duration, err := time.ParseDuration(value)
 				if err != nil {
@@ -146,11 +148,103 @@ func (r *VaultResources) Set(value string) error {
 				rn.maxJitter = maxJitter
 			case optionTtl:
 				rn.options["ttl"] = value
+			case optionNamespace:
+				rn.namespace = value
+			case optionVersion:
+				version, err := strconv.ParseInt(value, 10, 32)
+				if err != nil || version <= 0 {
+					return fmt.Errorf("the version option: %s is invalid, should be a positive integer", value)
+				}
+				if rn.resource != "secret" {
+					return fmt.Errorf("the version option is only supported for 'cn=secret' at this time")
+				}
+				rn.version = int(version)
+			case optionMetadata:
+				choice, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("the metadata option: %s is invalid, should be a boolean", value)
+				}
+				if rn.resource != "secret" {
+					return fmt.Errorf("the metadata option is only supported for 'cn=secret' at this time")
+				}
+				rn.kvMetadata = choice
+			case optionFields:
+				if rn.resource != "secret" {
+					return fmt.Errorf("the fields option is only supported for 'cn=secret' at this time")
+				}
+				for _, field := range strings.Split(value, ",") {
+					if field = strings.TrimSpace(field); field != "" {
+						rn.fields = append(rn.fields, field)
+					}
+				}
+			case optionCSR:
+				choice, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("the csr option: %s is invalid, should be a boolean", value)
+				}
+				if rn.resource != "pki" {
+					return fmt.Errorf("the csr option is only supported for 'cn=pki'")
+				}
+				rn.csr = choice
+			case optionRenewFraction:
+				fraction, err := strconv.ParseFloat(value, 64)
+				if err != nil || fraction <= 0 || fraction >= 1 {
+					return fmt.Errorf("the renew fraction option: %s is invalid, should be a fraction between 0 and 1", value)
+				}
+				if rn.resource != "pki" {
+					return fmt.Errorf("the renew fraction option is only supported for 'cn=pki'")
+				}
+				rn.renewFraction = fraction
+			case optionRevokeWithKey:
+				choice, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("the revoke with key option: %s is invalid, should be a boolean", value)
+				}
+				if rn.resource != "pki" {
+					return fmt.Errorf("the revoke with key option is only supported for 'cn=pki'")
+				}
+				rn.revokeWithKey = choice
+			case optionVerb:
+				switch strings.ToLower(value) {
+				case "read", "get":
+					rn.verb = "read"
+				case "write", "post", "put":
+					rn.verb = "write"
+				case "list":
+					rn.verb = "list"
+				default:
+					return fmt.Errorf("the verb option: %s is invalid, should be read, write or list", value)
+				}
+			case optionAlias:
+				if rn.resource != "pki" && rn.resource != "pki-ca" {
+					return fmt.Errorf("the alias option is only supported for 'cn=pki' and 'cn=pki-ca'")
+				}
+				rn.keystoreAlias = value
+			case optionKeystorePassword:
+				if rn.resource != "pki" && rn.resource != "pki-ca" {
+					return fmt.Errorf("the keystore password option is only supported for 'cn=pki' and 'cn=pki-ca'")
+				}
+				rn.keystorePassword = value
+			case optionKeystorePasswordEnv:
+				if rn.resource != "pki" && rn.resource != "pki-ca" {
+					return fmt.Errorf("the keystore password env option is only supported for 'cn=pki' and 'cn=pki-ca'")
+				}
+				rn.keystorePasswordEnv = value
+			case optionKeystorePasswordSecret:
+				if rn.resource != "pki" && rn.resource != "pki-ca" {
+					return fmt.Errorf("the keystore password secret option is only supported for 'cn=pki' and 'cn=pki-ca'")
+				}
+				rn.keystorePasswordSecret = value
 			default:
 				rn.options[name] = value
 			}
 		}
 	}
+	// step: a template or ca bundle is written out as is, unless another format is requested
+	if (rn.resource == "tpl" || rn.resource == "pki-ca") && !formatSet {
+		rn.format = "txt"
+	}
+
 	// step: append to the list of resources
 	r.items = append(r.items, rn)
 
@@ -43,6 +43,55 @@ func TestSetResources(t *testing.T) {
 	assert.NotNil(t, items.Set("file=filename.test,fmt=yaml"))
 }
 
+func TestSetResourceNamespace(t *testing.T) {
+	var items VaultResources
+	assert.Nil(t, items.Set("secret:secret/db:ns=team-a"))
+	assert.Equal(t, "team-a", items.items[0].namespace)
+	_, found := items.items[0].options[optionNamespace]
+	assert.False(t, found)
+}
+
+func TestSetResourceVerb(t *testing.T) {
+	var items VaultResources
+	assert.Nil(t, items.Set("logical:rabbitmq/creds/app"))
+	assert.Nil(t, items.Set("logical:nomad/creds/app:verb=POST,ttl=1h"))
+	assert.Nil(t, items.Set("pki:pki/issue/app:common_name=example.com"))
+	assert.Nil(t, items.Set("secret:secret/db:verb=write"))
+	assert.NotNil(t, items.Set("logical:nomad/creds/app:verb=patch"))
+	assert.Equal(t, "read", items.items[0].getVerb())
+	assert.Equal(t, "write", items.items[1].getVerb())
+	assert.Equal(t, "1h", items.items[1].options["ttl"])
+	_, found := items.items[1].options[optionVerb]
+	assert.False(t, found)
+	assert.Equal(t, "write", items.items[2].getVerb())
+	assert.Nil(t, items.items[1].IsValid())
+	assert.NotNil(t, items.items[3].IsValid())
+}
+
+func TestSetTemplateResource(t *testing.T) {
+	var items VaultResources
+	assert.Nil(t, items.Set("tpl:db:tpl=/etc/templates/db.tmpl,file=/etc/credentials"))
+	assert.Nil(t, items.Set("tpl:db:tpl=/etc/templates/db.tmpl,fmt=json"))
+	assert.Equal(t, "/etc/templates/db.tmpl", items.items[0].templateFile)
+	assert.Equal(t, "txt", items.items[0].format)
+	assert.Equal(t, "json", items.items[1].format)
+	assert.Nil(t, items.items[0].IsValid())
+}
+
+func TestSetKeystoreResource(t *testing.T) {
+	var items VaultResources
+	assert.Nil(t, items.Set("pki:pki/issue/app:common_name=example.com,fmt=jks,alias=app,keystore_password_env=APP_PASSWORD"))
+	assert.Nil(t, items.Set("pki-ca:pki:fmt=pkcs12,keystore_password=changeit"))
+	assert.Nil(t, items.Set("secret:secret/db:fmt=jks"))
+	assert.NotNil(t, items.Set("secret:secret/db:alias=app"))
+	assert.Equal(t, "app", items.items[0].keystoreAlias)
+	assert.Equal(t, "APP_PASSWORD", items.items[0].keystorePasswordEnv)
+	assert.Equal(t, map[string]string{"common_name": "example.com"}, items.items[0].options)
+	assert.Nil(t, items.items[0].IsValid())
+	assert.Nil(t, items.items[1].IsValid())
+	assert.NotNil(t, items.items[2].IsValid())
+}
+
 func TestSetEnvironmentResource(t *testing.T) {
 	tests := []struct {
 		ResourceText string
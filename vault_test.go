@@ -0,0 +1,234 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsAuthError(t *testing.T) {
+	assert.False(t, isAuthError(nil))
+	assert.False(t, isAuthError(errors.New("Code: 500. Errors: internal error")))
+	assert.False(t, isAuthError(&api.ResponseError{StatusCode: 404}))
+	assert.True(t, isAuthError(&api.ResponseError{StatusCode: 403}))
+	assert.True(t, isAuthError(fmt.Errorf("wrapped: %w", &api.ResponseError{StatusCode: 403})))
+	assert.True(t, isAuthError(errors.New("missing client token")))
+	assert.True(t, isAuthError(errors.New("Code: 403. Errors: permission denied")))
+}
+
+func TestResolveNamespace(t *testing.T) {
+	assert.Equal(t, "team-a", resolveNamespace("", "team-a"))
+	assert.Equal(t, "parent/team-a", resolveNamespace("parent", "team-a"))
+	assert.Equal(t, "parent/team-a", resolveNamespace("parent/", "team-a/"))
+	assert.Equal(t, "other", resolveNamespace("parent", "/other"))
+}
+
+func TestAuthenticateFallback(t *testing.T) {
+	var client *api.Client
+	current := "current"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/userpass/login/", func(w http.ResponseWriter, req *http.Request) {
+		// step: the shared client keeps the current token while the methods are tried
+		assert.Equal(t, current, client.Token())
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errors": ["invalid username or password"]}`)
+	})
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, req *http.Request) {
+		assert.Empty(t, req.Header.Get("X-Vault-Token"))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60}}`)
+	})
+	client = newTestVaultClient(t, mux)
+	client.SetToken(current)
+	t.Setenv("VAULT_TOKEN", "expired")
+
+	opts := &config{vaultAuthOptions: &vaultAuthOptions{
+		Method:   "userpass, token, approle",
+		Username: "user",
+		Password: "pass",
+		RoleID:   "role",
+		SecretID: "secret",
+	}}
+	auth, err := authenticate(client, opts, newUnwrapCache())
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+	assert.Equal(t, "foobar", client.Token())
+
+	// step: if every method fails the current token is kept
+	current = "foobar"
+	opts.vaultAuthOptions.Method = "userpass,unknown"
+	_, err = authenticate(client, opts, newUnwrapCache())
+	assert.Error(t, err)
+	assert.Equal(t, "foobar", client.Token())
+}
+
+func TestLogicalResource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/cassandra/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "GET", req.Method)
+		fmt.Fprintf(w, `{"lease_id": "cassandra/creds/app/1", "lease_duration": 60, "data": {"username": "user", "ttl": "%s"}}`,
+			req.URL.Query().Get("ttl"))
+	})
+	mux.HandleFunc("/v1/nomad/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "PUT", req.Method)
+		fmt.Fprint(w, `{"data": {"secret_id": "token"}}`)
+	})
+	mux.HandleFunc("/v1/secret/apps", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.URL.Query().Get("list"))
+		fmt.Fprint(w, `{"data": {"keys": ["a", "b"]}}`)
+	})
+	service := &VaultService{client: newTestVaultClient(t, mux)}
+
+	for _, c := range []struct {
+		Resource string
+		Expected map[string]interface{}
+	}{
+		{Resource: "cassandra:cassandra/creds/app:ttl=1h", Expected: map[string]interface{}{"username": "user", "ttl": ""}},
+		{Resource: "logical:cassandra/creds/app:ttl=1h", Expected: map[string]interface{}{"username": "user", "ttl": "1h"}},
+		{Resource: "cassandra:cassandra/creds/app:ttl=1h,verb=read", Expected: map[string]interface{}{"username": "user", "ttl": "1h"}},
+		{Resource: "logical:nomad/creds/app:verb=post", Expected: map[string]interface{}{"secret_id": "token"}},
+		{Resource: "logical:secret/apps:verb=list", Expected: map[string]interface{}{"keys": []interface{}{"a", "b"}}},
+	} {
+		var items VaultResources
+		require.NoError(t, items.Set(c.Resource))
+		require.NoError(t, items.items[0].IsValid())
+		rn := &watchedResource{resource: items.items[0]}
+		require.NoError(t, service.get(rn), c.Resource)
+		assert.Equal(t, c.Expected, rn.secret.Data, c.Resource)
+	}
+}
+
+func TestVaultServiceProcessorReauthenticate(t *testing.T) {
+	logins, reads := 0, 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, req *http.Request) {
+		logins++
+		fmt.Fprint(w, `{"auth": {"client_token": "renewed", "lease_duration": 3600}}`)
+	})
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "valid" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"ttl": 3600}}`)
+	})
+	mux.HandleFunc("/v1/sys/capabilities-self", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/aws/creds/denied", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	})
+	mux.HandleFunc("/v1/aws/creds/app", func(w http.ResponseWriter, req *http.Request) {
+		// step: the token has been revoked until we login again
+		if reads++; req.Header.Get("X-Vault-Token") != "renewed" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"lease_id": "aws/creds/app/1", "lease_duration": 3600, "data": {"access_key": "AKID"}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	client.SetToken("revoked")
+
+	statsInterval := options.statsInterval
+	options.statsInterval = time.Hour
+	defer func() { options.statsInterval = statsInterval }()
+	opts := &config{vaultAuthOptions: &vaultAuthOptions{Method: "approle", RoleID: "role", SecretID: "secret"}}
+	service := &VaultService{
+		client:          client,
+		tokens:          newTokenManager(client, opts),
+		resourceChannel: make(chan *watchedResource, 20),
+		retryDelay:      func(int) time.Duration { return 10 * time.Millisecond },
+	}
+	service.vaultServiceProcessor()
+
+	var items VaultResources
+	require.NoError(t, items.Set("aws:aws/creds/app"))
+	updates := make(chan VaultEvent, 10)
+	service.AddListener(updates)
+	service.Watch(items.items[0])
+
+	// step: the denied retrieval re-authenticates and the resource is retrieved again with the new token
+	var events []EventType
+	for len(events) < 2 {
+		select {
+		case evt := <-updates:
+			events = append(events, evt.Type)
+			if evt.Type == EventTypeSuccess {
+				assert.Equal(t, "AKID", evt.Secret["access_key"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the resource to be retrieved")
+		}
+	}
+	assert.Equal(t, []EventType{EventTypeFailure, EventTypeSuccess}, events)
+	assert.Equal(t, 1, logins)
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, "renewed", client.Token())
+
+	// step: a valid token denied a path isn't replaced, the resource is retried with a growing delay
+	client = newTestVaultClient(t, mux)
+	client.SetToken("valid")
+	var delays []int
+	service = &VaultService{
+		client:          client,
+		tokens:          newTokenManager(client, opts),
+		resourceChannel: make(chan *watchedResource, 20),
+		retryDelay: func(retries int) time.Duration {
+			delays = append(delays, retries)
+			return 10 * time.Millisecond
+		},
+	}
+	service.vaultServiceProcessor()
+	updates = make(chan VaultEvent, 10)
+	service.AddListener(updates)
+	require.NoError(t, items.Set("aws:aws/creds/denied"))
+	service.Watch(items.items[1])
+	for failures := 0; failures < 3; {
+		select {
+		case evt := <-updates:
+			require.Equal(t, EventTypeFailure, evt.Type)
+			failures++
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the resource to be retried")
+		}
+	}
+	assert.Equal(t, 1, logins)
+	assert.Equal(t, "valid", client.Token())
+	assert.Equal(t, []int{0, 1, 2}, delays[:3])
+}
+
+func TestRetryIn(t *testing.T) {
+	service := VaultService{}
+	assert.True(t, service.retryIn(0) >= 3*time.Second && service.retryIn(0) < 10*time.Second)
+	assert.True(t, service.retryIn(2) >= 12*time.Second && service.retryIn(2) < 40*time.Second)
+	assert.Equal(t, maximumRefreshBackoff, service.retryIn(20))
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"crypto/x509"
 	"time"
 
 	"github.com/golang/glog"
@@ -26,6 +27,10 @@ import (
 const (
 	renewalMinimum = 0.8
 	renewalMaximum = 0.95
+	// defaultKVPollInterval is how often a kv version 2 secret is checked for a new version
+	defaultKVPollInterval = time.Minute
+	// defaultCertRenewalFraction is how far through its validity a certificate is issued again
+	defaultCertRenewalFraction = 2.0 / 3.0
 )
 
 // watchedResource is a resource which is being watched - i.e. when the item is coming up for renewal
@@ -41,6 +46,16 @@ type watchedResource struct {
 	renewalTime time.Duration
 	// the secret
 	secret *api.Secret
+	// the secrets a template resource was rendered from
+	dependencies map[string]*templateDependency
+	// the leases of the secrets a template resource no longer uses
+	superseded []string
+	// indicates the resource changed when last retrieved
+	changed bool
+	// the kv mounts of the paths read by the resource
+	kvMounts map[string]*kvMount
+	// the kv metadata of the secret when last retrieved
+	metadata map[string]interface{}
 }
 
 // notifyOnRenewal creates a trigger and notifies when a resource is up for renewal
@@ -48,14 +63,31 @@ func (r *watchedResource) notifyOnRenewal(ch chan *watchedResource) {
 	go func() {
 		// step: check if the resource has a pre-configured renewal time
 		r.renewalTime = r.resource.update
+		// step: a certificate is issued again part way through its validity, regardless of the lease
+		if r.renewalTime <= 0 && r.resource.resource == "pki" {
+			certificate, err := parseCertificate(r.secret.Data)
+			if err != nil {
+				glog.Warningf("resource: %s, unable to parse the certificate, using the lease instead, error: %s", r.resource, err)
+			} else if time.Now().After(certificate.NotAfter) {
+				glog.Errorf("resource: %s, the certificate expired at: %s, refusing to schedule a renewal", r.resource, certificate.NotAfter)
+				return
+			} else {
+				r.renewalTime = r.certificateRenewal(certificate)
+			}
+		}
 		// step: if the answer is no, we set the notification between 80-95% of the lease time of the secret
 		if r.renewalTime <= 0 {
+			switch {
+			// a kv version 2 secret has no lease, we poll its metadata for a new version instead
+			case r.secret.LeaseDuration <= 0 && r.metadata != nil && r.resource.version == 0:
+				r.renewalTime = defaultKVPollInterval
 			// if there is no lease time, we canout set a renewal, just fade into the background
-			if r.secret.LeaseDuration <= 0 {
+			case r.secret.LeaseDuration <= 0:
 				glog.Warningf("resource: %s has no lease duration, no custom update set, so item will not be updated", r.resource.path)
 				return
+			default:
+				r.renewalTime = r.calculateRenewal()
 			}
-			r.renewalTime = r.calculateRenewal()
 		}
 		if r.resource.maxJitter != 0 {
 			glog.V(4).Infof("using maxJitter (%s) to calculate renewal time", r.resource.maxJitter)
@@ -72,6 +104,25 @@ func (r *watchedResource) notifyOnRenewal(ch chan *watchedResource) {
 	}()
 }
 
+// certificateRenewal returns the time until the certificate is due to be issued again
+func (r watchedResource) certificateRenewal(certificate *x509.Certificate) time.Duration {
+	fraction := r.resource.renewFraction
+	if fraction <= 0 {
+		fraction = defaultCertRenewalFraction
+	}
+	validity := certificate.NotAfter.Sub(certificate.NotBefore)
+	renewAt := certificate.NotBefore.Add(time.Duration(float64(validity) * fraction))
+	glog.Infof("resource: %s, the certificate: %s expires at: %s, renewing at: %s", r.resource,
+		certificate.Subject.CommonName, certificate.NotAfter, renewAt)
+
+	renewal := time.Until(renewAt)
+	if renewal < time.Second {
+		renewal = time.Second
+	}
+
+	return renewal
+}
+
 // calculateRenewal calculate the renewal between
 func (r watchedResource) calculateRenewal() time.Duration {
 	return time.Duration(getDurationWithin(
@@ -0,0 +1,166 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+// unwrapCache holds the credentials of the wrapping tokens which have been unwrapped; a wrapping token can only be
+// used once, so the credential is reused for as long as the same wrapping token is configured
+type unwrapCache struct {
+	// a lock protecting the credentials
+	lock sync.Mutex
+	// the credentials keyed by the wrapping token
+	credentials map[string]string
+}
+
+// newUnwrapCache creates an empty unwrap cache
+func newUnwrapCache() *unwrapCache {
+	return &unwrapCache{credentials: make(map[string]string)}
+}
+
+// get returns the credential unwrapped from the wrapping token, if any
+func (r *unwrapCache) get(wrapped string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	credential, found := r.credentials[wrapped]
+
+	return credential, found
+}
+
+// set records the credential unwrapped from the wrapping token
+func (r *unwrapCache) set(wrapped, credential string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.credentials[wrapped] = credential
+}
+
+// readWrappedValue retrieves a response-wrapping token from the options, a file or environment variables
+//
+//	value		: the wrapping token from the auth file
+//	filename	: the file containing the wrapping token from the auth file
+//	env		: the environment variable containing the wrapping token
+func readWrappedValue(value, filename, env string) (string, error) {
+	if value != "" {
+		return strings.TrimSpace(value), nil
+	}
+	if filename == "" {
+		filename = os.Getenv(env + "_FILE")
+	}
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the wrapping token file: %s, error: %s", filename, err)
+		}
+		return string(bytes.TrimSpace(content)), nil
+	}
+
+	return strings.TrimSpace(os.Getenv(env)), nil
+}
+
+// unwrapCredential unwraps the response-wrapping token and extracts the credential from it; as a wrapping token
+// can only be used once, the credential is kept in the cache and reused until the wrapping token changes
+//
+//	client		: the vault client
+//	cfg		: the authentication options
+//	unwrapped	: the credentials already unwrapped
+//	wrapped		: the response-wrapping token
+//	creationPaths	: the paths the wrapping token is expected to be created on
+//	extract		: extracts the credential from the unwrapped response
+func unwrapCredential(client *api.Client, cfg *vaultAuthOptions, unwrapped *unwrapCache, wrapped string,
+	creationPaths []string, extract func(*api.Secret) (string, error)) (string, error) {
+
+	if credential, found := unwrapped.get(wrapped); found {
+		return credential, nil
+	}
+	expected := cfg.WrappingPath
+	if expected == "" {
+		expected = os.Getenv("VAULT_SIDEKICK_WRAPPING_PATH")
+	}
+	if expected != "" {
+		creationPaths = []string{expected}
+	}
+
+	secret, err := unwrapSecret(client, wrapped, creationPaths)
+	if err != nil {
+		return "", err
+	}
+	credential, err := extract(secret)
+	if err != nil {
+		return "", err
+	}
+	unwrapped.set(wrapped, credential)
+
+	return credential, nil
+}
+
+// unwrapSecret checks the wrapping token was created on one of the expected paths and unwraps the response;
+// a token created elsewhere or already unwrapped indicates it may have been intercepted
+func unwrapSecret(client *api.Client, wrapped string, creationPaths []string) (*api.Secret, error) {
+	// step: use a clone of the client, keeping the namespace, as the wrapping token is used as the client token
+	clone, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil, err
+	}
+	clone.SetToken(wrapped)
+
+	lookup, err := clone.Logical().Write("sys/wrapping/lookup", map[string]interface{}{"token": wrapped})
+	if err != nil {
+		return nil, fmt.Errorf("unable to lookup the wrapping token, it may have been used already, error: %s", err)
+	}
+	if lookup == nil || lookup.Data == nil {
+		return nil, fmt.Errorf("no information returned on the wrapping token")
+	}
+	creationPath, _ := lookup.Data["creation_path"].(string)
+	if !matchCreationPath(creationPath, creationPaths) {
+		return nil, fmt.Errorf("the wrapping token was created on: '%s', expected: %s, refusing to unwrap",
+			creationPath, strings.Join(creationPaths, ", "))
+	}
+	glog.V(3).Infof("unwrapping the response-wrapped credential created on: %s", creationPath)
+
+	secret, err := clone.Logical().Unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap the wrapping token, error: %s", err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("nothing returned on unwrapping the token")
+	}
+
+	return secret, nil
+}
+
+// matchCreationPath checks the creation path matches any of the patterns
+func matchCreationPath(creationPath string, patterns []string) bool {
+	creationPath = strings.Trim(creationPath, "/")
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.Trim(pattern, "/"), creationPath); matched {
+			return true
+		}
+	}
+
+	return false
+}
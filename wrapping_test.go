@@ -0,0 +1,99 @@
+/*
+Copyright 2015 Home Office All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWrappingServer fakes the wrapping endpoints and approle login of vault
+func newTestWrappingServer(t *testing.T, creationPath string, unwraps *int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/wrapping/lookup", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"data": {"creation_path": "%s", "creation_ttl": 60}}`, creationPath)
+	})
+	mux.HandleFunc("/v1/sys/wrapping/unwrap", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "wrapped", req.Header.Get("X-Vault-Token"))
+		*unwraps++
+		fmt.Fprint(w, `{"data": {"secret_id": "unwrapped-secret", "secret_id_accessor": "acc"}}`)
+	})
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, req *http.Request) {
+		var login appRoleLogin
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+		assert.Equal(t, "unwrapped-secret", login.SecretID)
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar", "lease_duration": 60}}`)
+	})
+
+	return mux
+}
+
+func TestAppRolePluginWrappedSecretID(t *testing.T) {
+	unwraps := 0
+	client := newTestVaultClient(t, newTestWrappingServer(t, "auth/approle/role/app/secret-id", &unwraps))
+	cfg := &vaultAuthOptions{RoleID: "app", WrappedSecretID: "wrapped"}
+	unwrapped := newUnwrapCache()
+
+	auth, err := NewAppRolePlugin(client, unwrapped).Create(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", auth.ClientToken)
+
+	// step: the secret id should be reused on the next login
+	_, err = NewAppRolePlugin(client, unwrapped).Create(&vaultAuthOptions{RoleID: "app", WrappedSecretID: "wrapped"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, unwraps)
+}
+
+func TestAppRolePluginWrappedSecretIDTampered(t *testing.T) {
+	unwraps := 0
+	client := newTestVaultClient(t, newTestWrappingServer(t, "sys/wrapping/wrap", &unwraps))
+
+	_, err := NewAppRolePlugin(client, newUnwrapCache()).Create(&vaultAuthOptions{RoleID: "app", WrappedSecretID: "wrapped"})
+	assert.Error(t, err)
+	assert.Equal(t, 0, unwraps)
+}
+
+func TestUnwrapSecretNamespace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/wrapping/lookup", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "team-a", req.Header.Get("X-Vault-Namespace"))
+		fmt.Fprint(w, `{"data": {"creation_path": "auth/token/create", "creation_ttl": 60}}`)
+	})
+	mux.HandleFunc("/v1/sys/wrapping/unwrap", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "team-a", req.Header.Get("X-Vault-Namespace"))
+		fmt.Fprint(w, `{"auth": {"client_token": "foobar"}}`)
+	})
+	client := newTestVaultClient(t, mux)
+	client.SetNamespace("team-a")
+
+	// step: the wrapping token is used in the namespace of the client
+	secret, err := unwrapSecret(client, "wrapped", []string{"auth/token/create"})
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", secret.Auth.ClientToken)
+}
+
+func TestMatchCreationPath(t *testing.T) {
+	assert.True(t, matchCreationPath("auth/approle/role/app/secret-id", []string{"auth/approle/role/*/secret-id"}))
+	assert.True(t, matchCreationPath("auth/token/create-orphan", []string{"auth/token/create", "auth/token/create-orphan"}))
+	assert.False(t, matchCreationPath("sys/wrapping/wrap", []string{"auth/approle/role/*/secret-id"}))
+	assert.False(t, matchCreationPath("", []string{"auth/token/create"}))
+}